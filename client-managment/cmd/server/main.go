@@ -3,35 +3,65 @@ package main
 import (
 	grpcserver "client-manager/grpc"
 	initx "client-manager/init"
+	"context"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	"log"
+	"log/slog"
 	"net"
 	"os"
+	"strconv"
+	"time"
 
 	"client-manager/config"
 	"client-manager/handler"
+	"client-manager/logging"
 )
 
 func main() {
 	if err := config.LoadConfigFromJSON("config/config.json"); err != nil {
-		log.Fatal("cannot load config.json:", err)
+		fatal("cannot load config.json", err)
 	}
+	logging.Setup("client-manager")
+	if _, err := initx.InitTracing(context.Background(), "client-manager"); err != nil {
+		fatal("tracing", err)
+	}
+
 	db, err := gorm.Open(mysql.Open(os.Getenv("DATABASE_URL")), &gorm.Config{})
 	if err != nil {
-		log.Fatal(err)
+		fatal("db connect", err)
 	}
 	err = initx.Run(db)
 	if err != nil {
-
+		fatal("migrate", err)
 	}
 	svc := handler.New(db)
 	_ = svc.(*handler.Svc).AutoMigrate()
 
+	sweep := time.Duration(atoi(os.Getenv("RESERVATION_SWEEP_SEC"))) * time.Second
+	if sweep <= 0 {
+		sweep = time.Minute
+	}
+	go svc.(*handler.Svc).RunExpirySweeper(context.Background(), sweep)
+
 	lis, _ := net.Listen("tcp", "0.0.0.0:"+os.Getenv("GRPC_PORT"))
-	gs := grpc.NewServer()
+	gs := grpc.NewServer(
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(logging.UnaryServer),
+		grpc.ChainStreamInterceptor(logging.StreamServer),
+	)
 	grpcserver.Register(gs, svc)
-	log.Println("gRPC on :" + os.Getenv("GRPC_PORT"))
-	log.Fatal(gs.Serve(lis))
+	slog.Info("gRPC listening", "port", os.Getenv("GRPC_PORT"))
+	fatal("grpc serve", gs.Serve(lis))
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
@@ -4,6 +4,7 @@ import (
 	clientpb "client-manager/gen"
 	"context"
 	"errors"
+	"time"
 
 	"client-manager/handler"
 
@@ -41,14 +42,34 @@ func (s *Server) GetClient(ctx context.Context, req *clientpb.GetClientRequest)
 		}
 		return nil, status.Errorf(codes.Internal, "db: %v", err)
 	}
+	return clientResponse(c), nil
+}
+
+func (s *Server) SetQueueWeight(ctx context.Context, req *clientpb.SetQueueWeightRequest) (*clientpb.GetClientResponse, error) {
+	c, err := s.h.SetQueueWeight(req.GetClientId(), req.GetQueueWeight())
+	if err != nil {
+		switch {
+		case errors.Is(err, handler.ErrInvalidWeight):
+			return nil, status.Errorf(codes.InvalidArgument, "queue_weight must be 1 to %d", handler.MaxQueueWeight)
+		case errors.Is(err, handler.ErrNotFound):
+			return nil, status.Error(codes.NotFound, "client_not_found")
+		}
+		return nil, status.Errorf(codes.Internal, "db: %v", err)
+	}
+	return clientResponse(c), nil
+}
+
+func clientResponse(c handler.Client) *clientpb.GetClientResponse {
 	return &clientpb.GetClientResponse{
 		Client: &clientpb.Client{
 			ClientId:      c.ClientID,
 			BalanceMinor:  c.BalanceMinor,
+			ReservedMinor: c.ReservedMinor,
+			QueueWeight:   c.QueueWeight,
 			CreatedAtUnix: c.CreatedAt.Unix(),
 			UpdatedAtUnix: c.UpdatedAt.Unix(),
 		},
-	}, nil
+	}
 }
 
 func (s *Server) GetPricePlan(ctx context.Context, req *clientpb.GetPricePlanRequest) (*clientpb.GetPricePlanResponse, error) {
@@ -92,3 +113,61 @@ func (s *Server) Refund(ctx context.Context, req *clientpb.MoneyRequest) (*clien
 	}
 	return &clientpb.MoneyResponse{BalanceAfter: after}, nil
 }
+
+func (s *Server) Reserve(ctx context.Context, req *clientpb.ReserveRequest) (*clientpb.ReservationResponse, error) {
+	if req.GetAmountMinor() <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "amount_minor must be positive")
+	}
+	r, bal, err := s.h.Reserve(req.GetClientId(), req.GetAmountMinor(), req.GetRef(), time.Duration(req.GetTtlSec())*time.Second)
+	if err != nil {
+		return nil, reservationError("reserve", err)
+	}
+	return reservationResponse(r, bal), nil
+}
+
+func (s *Server) Capture(ctx context.Context, req *clientpb.SettleRequest) (*clientpb.ReservationResponse, error) {
+	r, bal, err := s.h.Capture(req.GetClientId(), req.GetReservationId(), req.GetAmountMinor(), req.GetRef())
+	if err != nil {
+		return nil, reservationError("capture", err)
+	}
+	return reservationResponse(r, bal), nil
+}
+
+func (s *Server) Release(ctx context.Context, req *clientpb.SettleRequest) (*clientpb.ReservationResponse, error) {
+	r, bal, err := s.h.Release(req.GetClientId(), req.GetReservationId(), req.GetAmountMinor(), req.GetRef())
+	if err != nil {
+		return nil, reservationError("release", err)
+	}
+	return reservationResponse(r, bal), nil
+}
+
+func reservationError(op string, err error) error {
+	switch {
+	case errors.Is(err, handler.ErrInsufficientFunds):
+		return status.Error(codes.FailedPrecondition, "insufficient_funds")
+	case errors.Is(err, handler.ErrReservationClosed):
+		return status.Error(codes.FailedPrecondition, "reservation_closed")
+	case errors.Is(err, handler.ErrExceedsReservation):
+		return status.Error(codes.InvalidArgument, "exceeds_reservation")
+	case errors.Is(err, handler.ErrRefUsed):
+		return status.Error(codes.AlreadyExists, "ref_used")
+	case errors.Is(err, handler.ErrNotFound):
+		return status.Error(codes.NotFound, "not_found")
+	}
+	return status.Errorf(codes.Internal, "%s: %v", op, err)
+}
+
+func reservationResponse(r handler.Reservation, bal handler.Balances) *clientpb.ReservationResponse {
+	return &clientpb.ReservationResponse{
+		Reservation: &clientpb.Reservation{
+			ReservationId:  r.ID,
+			ClientId:       r.ClientID,
+			Status:         r.Status,
+			AmountMinor:    r.AmountMinor,
+			RemainingMinor: r.Remaining(),
+			ExpiresAtUnix:  r.ExpiresAt.Unix(),
+		},
+		AvailableAfter: bal.Available,
+		ReservedAfter:  bal.Reserved,
+	}
+}
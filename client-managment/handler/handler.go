@@ -11,34 +11,52 @@ import (
 var (
 	ErrNotFound          = gorm.ErrRecordNotFound
 	ErrInsufficientFunds = errors.New("insufficient_funds")
+	ErrInvalidWeight     = errors.New("invalid_queue_weight")
 )
 
+// MaxQueueWeight caps Client.QueueWeight.
+const MaxQueueWeight = 1000
+
+// Client balances: BalanceMinor is what is available to spend,
+// ReservedMinor is held by open reservations. QueueWeight is the client's
+// share of message-manager's fair queue relative to other clients.
 type Client struct {
-	ClientID     string `gorm:"primaryKey"`
-	BalanceMinor int64
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ClientID      string `gorm:"primaryKey"`
+	BalanceMinor  int64
+	ReservedMinor int64
+	QueueWeight   int32 `gorm:"not null;default:1"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 type PricePlan struct {
 	ClientID           string `gorm:"primaryKey"`
 	NormalPriceMinor   int64
 	PriorityPriceMinor int64
 }
+
+// Transaction is a ledger entry. A non-empty Ref makes the entry
+// idempotent: (ClientID, Type, Ref) is unique, and repeating a request
+// with the same ref returns the stored BalanceAfter without applying again.
 type Transaction struct {
-	ID          uint `gorm:"primaryKey"`
-	ClientID    string
-	AmountMinor int64  // +refund, -debit
-	Type        string // DEBIT|REFUND
-	Ref         string
-	CreatedAt   time.Time
+	ID           uint   `gorm:"primaryKey"`
+	ClientID     string `gorm:"size:64;uniqueIndex:idx_tx_client_type_ref"`
+	AmountMinor  int64  // +refund, -debit
+	BalanceAfter int64
+	Type         string  `gorm:"size:16;uniqueIndex:idx_tx_client_type_ref"`  // DEBIT|REFUND
+	Ref          *string `gorm:"size:128;uniqueIndex:idx_tx_client_type_ref"` // NULL when no ref given
+	CreatedAt    time.Time
 }
 
 type Service interface {
 	CreateClient(clientID string, initial, normalPrice, priorityPrice int64) error
 	GetClient(clientID string) (Client, error)
 	GetPricePlan(clientID string) (PricePlan, error)
+	SetQueueWeight(clientID string, weight int32) (Client, error)
 	Debit(clientID string, amount int64, ref string) (balanceAfter int64, err error)
 	Refund(clientID string, amount int64, ref string) (balanceAfter int64, err error)
+	Reserve(clientID string, amount int64, ref string, ttl time.Duration) (Reservation, Balances, error)
+	Capture(clientID, reservationID string, amount int64, ref string) (Reservation, Balances, error)
+	Release(clientID, reservationID string, amount int64, ref string) (Reservation, Balances, error)
 }
 
 type Svc struct{ db *gorm.DB }
@@ -46,7 +64,7 @@ type Svc struct{ db *gorm.DB }
 func New(db *gorm.DB) Service { return &Svc{db: db} }
 
 func (s *Svc) AutoMigrate() error {
-	return s.db.AutoMigrate(&Client{}, &PricePlan{}, &Transaction{})
+	return s.db.AutoMigrate(&Client{}, &PricePlan{}, &Transaction{}, &Reservation{}, &ReservationEntry{})
 }
 
 func (s *Svc) CreateClient(id string, initial, normal, priority int64) error {
@@ -74,39 +92,79 @@ func (s *Svc) GetPricePlan(id string) (PricePlan, error) {
 	return p, s.db.First(&p, "client_id = ?", id).Error
 }
 
-func (s *Svc) Debit(id string, amount int64, ref string) (int64, error) {
-	var after int64
+func (s *Svc) SetQueueWeight(id string, weight int32) (Client, error) {
+	if weight < 1 || weight > MaxQueueWeight {
+		return Client{}, ErrInvalidWeight
+	}
+	var c Client
 	err := s.db.Transaction(func(tx *gorm.DB) error {
-		var c Client
-		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&c, "client_id = ?", id).Error; err != nil {
+		var err error
+		if c, err = lockClient(tx, id); err != nil {
 			return err
 		}
-		if c.BalanceMinor < amount {
-			return ErrInsufficientFunds
-		}
-		c.BalanceMinor -= amount
-		if err := tx.Save(&c).Error; err != nil {
-			return err
-		}
-		after = c.BalanceMinor
-		return tx.Create(&Transaction{ClientID: id, AmountMinor: -amount, Type: "DEBIT", Ref: ref}).Error
+		c.QueueWeight = weight
+		return tx.Model(&c).Update("queue_weight", weight).Error
 	})
-	return after, err
+	return c, err
+}
+
+func (s *Svc) Debit(id string, amount int64, ref string) (int64, error) {
+	return s.move(id, -amount, "DEBIT", ref)
 }
 
 func (s *Svc) Refund(id string, amount int64, ref string) (int64, error) {
+	return s.move(id, amount, "REFUND", ref)
+}
+
+// move changes the balance by delta and writes the ledger entry. When ref
+// was already used for this client and type, the original balance_after
+// is returned and nothing is applied.
+func (s *Svc) move(id string, delta int64, typ, ref string) (int64, error) {
 	var after int64
 	err := s.db.Transaction(func(tx *gorm.DB) error {
 		var c Client
 		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&c, "client_id = ?", id).Error; err != nil {
 			return err
 		}
-		c.BalanceMinor += amount
+		// looked up under the client lock, so concurrent retries serialize here
+		if prev, ok, err := findByRef(tx, id, typ, ref); err != nil || ok {
+			after = prev.BalanceAfter
+			return err
+		}
+		if c.BalanceMinor+delta < 0 {
+			return ErrInsufficientFunds
+		}
+		c.BalanceMinor += delta
 		if err := tx.Save(&c).Error; err != nil {
 			return err
 		}
 		after = c.BalanceMinor
-		return tx.Create(&Transaction{ClientID: id, AmountMinor: amount, Type: "REFUND", Ref: ref}).Error
+		return tx.Create(&Transaction{ClientID: id, AmountMinor: delta, BalanceAfter: after, Type: typ, Ref: refPtr(ref)}).Error
 	})
+	if err != nil && ref != "" {
+		// lost a race on the unique index: the winner's result is ours
+		if prev, ok, ferr := findByRef(s.db, id, typ, ref); ferr == nil && ok {
+			return prev.BalanceAfter, nil
+		}
+	}
 	return after, err
 }
+
+func findByRef(db *gorm.DB, id, typ, ref string) (Transaction, bool, error) {
+	var t Transaction
+	if ref == "" {
+		return t, false, nil
+	}
+	err := db.Where("client_id = ? AND type = ? AND ref = ?", id, typ, ref).First(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return t, false, nil
+	}
+	return t, err == nil, err
+}
+
+func refPtr(ref string) *string {
+	if ref == "" {
+		return nil
+	}
+	return &ref
+}
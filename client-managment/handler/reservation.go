@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrReservationClosed  = errors.New("reservation_closed")
+	ErrExceedsReservation = errors.New("exceeds_reservation")
+	ErrRefUsed            = errors.New("ref_used")
+)
+
+const DefaultReservationTTL = 48 * time.Hour
+
+// Reservation holds part of a client's balance until it is captured
+// (charged) or released (given back). Both may happen in parts; the
+// reservation stays HELD until nothing remains. A non-empty Ref makes
+// Reserve idempotent per client while the reservation is HELD; once it is
+// settled the ref cannot be reserved again.
+type Reservation struct {
+	ID            string  `gorm:"primaryKey;size:32"`
+	ClientID      string  `gorm:"size:64;uniqueIndex:idx_res_client_ref"`
+	Ref           *string `gorm:"size:128;uniqueIndex:idx_res_client_ref"`
+	AmountMinor   int64
+	CapturedMinor int64
+	ReleasedMinor int64
+	Status        string    `gorm:"size:16;index:idx_res_status_expires"` // HELD|CAPTURED|RELEASED|SETTLED
+	ExpiresAt     time.Time `gorm:"index:idx_res_status_expires"`
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+func (r Reservation) Remaining() int64 { return r.AmountMinor - r.CapturedMinor - r.ReleasedMinor }
+
+// ReservationEntry is one capture or release against a reservation; a
+// non-empty Ref makes that step idempotent.
+type ReservationEntry struct {
+	ID            uint    `gorm:"primaryKey"`
+	ReservationID string  `gorm:"size:32;uniqueIndex:idx_resentry_ref"`
+	Kind          string  `gorm:"size:16;uniqueIndex:idx_resentry_ref"` // CAPTURE|RELEASE
+	Ref           *string `gorm:"size:128;uniqueIndex:idx_resentry_ref"`
+	AmountMinor   int64
+	CreatedAt     time.Time
+}
+
+// Balances is a client's available and reserved balance after an operation.
+type Balances struct {
+	Available int64
+	Reserved  int64
+}
+
+func newReservationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func lockClient(tx *gorm.DB, id string) (Client, error) {
+	var c Client
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&c, "client_id = ?", id).Error
+	return c, err
+}
+
+func (s *Svc) Reserve(id string, amount int64, ref string, ttl time.Duration) (Reservation, Balances, error) {
+	if ttl <= 0 {
+		ttl = DefaultReservationTTL
+	}
+	var r Reservation
+	var bal Balances
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		c, err := lockClient(tx, id)
+		if err != nil {
+			return err
+		}
+		bal = Balances{Available: c.BalanceMinor, Reserved: c.ReservedMinor}
+		if ref != "" {
+			err := tx.First(&r, "client_id = ? AND ref = ?", id, ref).Error
+			if err == nil {
+				if r.Status != "HELD" || r.AmountMinor != amount {
+					// not a retry: someone else's request, or one long settled
+					return ErrRefUsed
+				}
+				return nil
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		if c.BalanceMinor < amount {
+			return ErrInsufficientFunds
+		}
+		rid, err := newReservationID()
+		if err != nil {
+			return err
+		}
+		c.BalanceMinor -= amount
+		c.ReservedMinor += amount
+		if err := tx.Save(&c).Error; err != nil {
+			return err
+		}
+		bal = Balances{Available: c.BalanceMinor, Reserved: c.ReservedMinor}
+		now := time.Now()
+		r = Reservation{ID: rid, ClientID: id, Ref: refPtr(ref), AmountMinor: amount, Status: "HELD", ExpiresAt: now.Add(ttl), CreatedAt: now, UpdatedAt: now}
+		return tx.Create(&r).Error
+	})
+	return r, bal, err
+}
+
+// Capture charges amount (everything left when 0) of a reservation and
+// writes it to the ledger as a DEBIT with the same ref.
+func (s *Svc) Capture(id, resID string, amount int64, ref string) (Reservation, Balances, error) {
+	return s.settle(id, resID, "CAPTURE", amount, ref)
+}
+
+// Release gives amount (everything left when 0) of a reservation back to
+// the available balance. Nothing is written to the ledger.
+func (s *Svc) Release(id, resID string, amount int64, ref string) (Reservation, Balances, error) {
+	return s.settle(id, resID, "RELEASE", amount, ref)
+}
+
+func (s *Svc) settle(id, resID, kind string, amount int64, ref string) (Reservation, Balances, error) {
+	var r Reservation
+	var bal Balances
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		c, err := lockClient(tx, id)
+		if err != nil {
+			return err
+		}
+		bal = Balances{Available: c.BalanceMinor, Reserved: c.ReservedMinor}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&r, "id = ? AND client_id = ?", resID, id).Error; err != nil {
+			return err
+		}
+		if ref != "" {
+			var e ReservationEntry
+			err := tx.First(&e, "reservation_id = ? AND kind = ? AND ref = ?", resID, kind, ref).Error
+			if err == nil {
+				return nil // already done
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return err
+			}
+		}
+		if r.Status != "HELD" {
+			return ErrReservationClosed
+		}
+		if amount == 0 {
+			amount = r.Remaining()
+		}
+		if amount < 0 || amount > r.Remaining() {
+			return ErrExceedsReservation
+		}
+
+		c.ReservedMinor -= amount
+		if kind == "CAPTURE" {
+			r.CapturedMinor += amount
+		} else {
+			r.ReleasedMinor += amount
+			c.BalanceMinor += amount
+		}
+		if err := tx.Save(&c).Error; err != nil {
+			return err
+		}
+		bal = Balances{Available: c.BalanceMinor, Reserved: c.ReservedMinor}
+		r.Status = settledStatus(r)
+		r.UpdatedAt = time.Now()
+		if err := tx.Save(&r).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&ReservationEntry{ReservationID: r.ID, Kind: kind, Ref: refPtr(ref), AmountMinor: amount}).Error; err != nil {
+			return err
+		}
+		if kind == "CAPTURE" {
+			return tx.Create(&Transaction{ClientID: id, AmountMinor: -amount, BalanceAfter: c.BalanceMinor, Type: "DEBIT", Ref: refPtr(ref)}).Error
+		}
+		return nil
+	})
+	return r, bal, err
+}
+
+func settledStatus(r Reservation) string {
+	switch {
+	case r.Remaining() > 0:
+		return "HELD"
+	case r.CapturedMinor == 0:
+		return "RELEASED"
+	case r.ReleasedMinor == 0:
+		return "CAPTURED"
+	}
+	return "SETTLED"
+}
+
+// ReleaseExpired releases whatever is left on reservations past their
+// expiry and reports how many it released.
+func (s *Svc) ReleaseExpired(limit int) (int, error) {
+	var rs []Reservation
+	if err := s.db.Where("status = ? AND expires_at < ?", "HELD", time.Now()).
+		Order("expires_at").Limit(limit).Find(&rs).Error; err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range rs {
+		if _, _, err := s.Release(r.ClientID, r.ID, 0, "expired"); err != nil {
+			if errors.Is(err, ErrReservationClosed) {
+				continue
+			}
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// RunExpirySweeper calls ReleaseExpired every interval until ctx is done.
+func (s *Svc) RunExpirySweeper(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n, err := s.ReleaseExpired(500)
+			if err != nil {
+				slog.Error("reservation sweep failed", "err", err)
+			}
+			if n > 0 {
+				slog.Info("reservation sweep", "released", n)
+			}
+		}
+	}
+}
@@ -10,10 +10,11 @@ import (
 
 func Run(db *gorm.DB) error {
 	type Client struct {
-		ClientID     string `gorm:"primaryKey"`
-		BalanceMinor int64
-		CreatedAt    time.Time
-		UpdatedAt    time.Time
+		ClientID      string `gorm:"primaryKey"`
+		BalanceMinor  int64
+		ReservedMinor int64
+		CreatedAt     time.Time
+		UpdatedAt     time.Time
 	}
 	type PricePlan struct {
 		ClientID           string `gorm:"primaryKey"`
@@ -21,14 +22,21 @@ func Run(db *gorm.DB) error {
 		PriorityPriceMinor int64
 	}
 	type Transaction struct {
-		ID          uint `gorm:"primaryKey"`
-		ClientID    string
-		AmountMinor int64
-		Type        string
-		Ref         string
-		CreatedAt   time.Time
+		ID           uint   `gorm:"primaryKey"`
+		ClientID     string `gorm:"size:64;uniqueIndex:idx_tx_client_type_ref"`
+		AmountMinor  int64
+		BalanceAfter int64
+		Type         string  `gorm:"size:16;uniqueIndex:idx_tx_client_type_ref"`
+		Ref          *string `gorm:"size:128;uniqueIndex:idx_tx_client_type_ref"`
+		CreatedAt    time.Time
 	}
 
+	if db.Migrator().HasTable(&Transaction{}) {
+		// legacy rows used '' for "no ref"; NULLs stay out of the unique index
+		if err := db.Exec("UPDATE transactions SET ref = NULL WHERE ref = ''").Error; err != nil {
+			return err
+		}
+	}
 	if err := db.AutoMigrate(&Client{}, &PricePlan{}, &Transaction{}); err != nil {
 		return err
 	}
@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type clientIDGetter interface{ GetClientId() string }
+
+// serverContext tags an incoming call's context from its metadata, falling
+// back to the request's client_id field for the client ID.
+func serverContext(ctx context.Context, req any) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	rid := first(md, "x-request-id")
+	if rid == "" {
+		rid = NewRequestID()
+	}
+	ctx = With(ctx, RequestID, rid)
+	cid := first(md, "x-client-id")
+	if g, ok := req.(clientIDGetter); ok && cid == "" {
+		cid = g.GetClientId()
+	}
+	return With(ctx, ClientID, cid)
+}
+
+func first(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "grpc request", "method", method, "code", code.String(), "duration_ms", time.Since(start).Milliseconds())
+}
+
+// UnaryServer tags the call context with the request and client IDs and
+// logs one line per call.
+func UnaryServer(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx = serverContext(ctx, req)
+	resp, err := next(ctx, req)
+	logCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+type taggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s taggedStream) Context() context.Context { return s.ctx }
+
+// StreamServer tags and logs streaming calls once they end.
+func StreamServer(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+	start := time.Now()
+	ctx := serverContext(ss.Context(), nil)
+	err := next(srv, taggedStream{ServerStream: ss, ctx: ctx})
+	logCall(ctx, info.FullMethod, start, err)
+	return err
+}
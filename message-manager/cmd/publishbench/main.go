@@ -0,0 +1,84 @@
+// Command publishbench runs the publisher against a real broker and
+// database: it stores -n CREATED messages, publishes them with
+// handler.API.PublishAll and reports how many per second reach QUEUED. It
+// exits non-zero below -target msg/s. BenchmarkPublisher in handler
+// measures the same loop with a fake writer under go test -bench.
+//
+// It reads DATABASE_URL and KAFKA_BROKERS like the server and writes to
+// its own topic and client ID; point it at a scratch database, e.g.
+//
+//	docker compose up -d redpanda mysql-mm
+//	DATABASE_URL='root:password@tcp(localhost:3308)/mm?parseTime=True' \
+//	KAFKA_BROKERS=localhost:9092 go run ./cmd/publishbench -n 100000
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"message-manager/handler"
+	initx "message-manager/init"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func main() {
+	n := flag.Int("n", 100000, "messages to publish")
+	batch := flag.Int("batch", 500, "publisher batch size")
+	linger := flag.Duration("linger", 5*time.Millisecond, "publisher linger")
+	topic := flag.String("topic", "sms.bench.v1", "topic to publish to")
+	target := flag.Float64("target", 10000, "minimum msg/s")
+	flag.Parse()
+
+	db, err := initx.OpenDBFromEnv()
+	if err != nil {
+		fatal("db connect", err)
+	}
+	routing, err := handler.NewRouting("BENCH", []handler.RoutingClass{{Name: "BENCH", Topic: *topic, PriceColumn: handler.PriceColumnNormal}})
+	if err != nil {
+		fatal("routing", err)
+	}
+	w := initx.NewWriter(initx.BrokersFromEnv(), *topic)
+	defer w.Close()
+	api := handler.NewAPI(db, routing, map[string]handler.TopicWriter{*topic: w}, nil, nil, 1, 1)
+	api.Publish = handler.PublishConfig{BatchSize: *batch, Linger: *linger}
+	if err := api.AutoMigrate(); err != nil {
+		fatal("migrate", err)
+	}
+
+	// warm up the connection and create the topic outside the timing
+	if err := w.WriteMessages(context.Background(), kafka.Message{Value: []byte("warmup")}); err != nil {
+		fatal("warmup", err)
+	}
+
+	clientID := fmt.Sprintf("bench-%d", time.Now().Unix())
+	msgs := make([]handler.Message, *n)
+	now := time.Now()
+	for i := range msgs {
+		msgs[i] = handler.Message{ClientID: clientID, To: fmt.Sprintf("+98912%07d", i), Body: "publishbench", Type: "BENCH", PriceMinor: 1, Status: "CREATED", CreatedAt: now, UpdatedAt: now}
+	}
+	if err := db.CreateInBatches(&msgs, 1000).Error; err != nil {
+		fatal("store messages", err)
+	}
+	slog.Info("stored", "messages", *n, "client_id", clientID)
+
+	start := time.Now()
+	queued := api.PublishAll(msgs)
+	elapsed := time.Since(start)
+
+	rate := float64(queued) / elapsed.Seconds()
+	fmt.Printf("published %d/%d messages in %s: %.0f msg/s (batch %d, linger %s)\n", queued, *n, elapsed.Round(time.Millisecond), rate, *batch, *linger)
+	if queued != *n || rate < *target {
+		fmt.Fprintf(os.Stderr, "below target: want all %d messages at >= %.0f msg/s\n", *n, *target)
+		os.Exit(1)
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
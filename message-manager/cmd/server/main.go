@@ -2,35 +2,88 @@ package main
 
 import (
 	"context"
-	"log"
+	"encoding/base64"
+	"errors"
+	"log/slog"
 	clientpb "message-manager/gen"
+	grpcserver "message-manager/grpc"
 	"message-manager/handler"
 	initx "message-manager/init"
+	"message-manager/logging"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"google.golang.org/grpc"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	if err := initx.LoadConfigFromJSON("config/config.json"); err != nil {
-		log.Fatal("load config:", err)
+		fatal("load config", err)
+	}
+	logging.Setup("message-manager")
+
+	flushTraces, err := initx.InitTracing(ctx, "message-manager")
+	if err != nil {
+		fatal("tracing", err)
 	}
 
 	db, err := initx.OpenDBFromEnv()
 	if err != nil {
-		log.Fatal("db connect:", err)
+		fatal("db connect", err)
+	}
+	if keks := os.Getenv("MESSAGE_KEKS"); keks != "" {
+		indexKey, err := base64.StdEncoding.DecodeString(os.Getenv("MESSAGE_INDEX_KEY"))
+		if err != nil {
+			fatal("MESSAGE_INDEX_KEY", err)
+		}
+		kr, err := handler.ParseKeyring(keks, os.Getenv("MESSAGE_KEK_ACTIVE"), indexKey)
+		if err != nil {
+			fatal("MESSAGE_KEKS", err)
+		}
+		handler.SetKeyring(kr)
+	} else {
+		slog.Warn("MESSAGE_KEKS not set; message bodies and recipients are stored in plaintext")
 	}
 
+	routing, err := loadRouting()
+	if err != nil {
+		fatal("routing classes", err)
+	}
 	brokers := initx.BrokersFromEnv()
-	wNormal := initx.NewWriter(brokers, os.Getenv("TOPIC_NORMAL"))
-	wPriority := initx.NewWriter(brokers, os.Getenv("TOPIC_PRIORITY"))
+	breakers := handler.BreakerConfig{
+		Failures: int(atoi64(os.Getenv("BREAKER_FAILURES"))),
+		Cooldown: seconds("BREAKER_COOLDOWN_SEC"),
+	}
+	writers := map[string]handler.TopicWriter{}
+	kafkaBreakers := map[string]*handler.Breaker{}
+	for _, t := range routing.Topics() {
+		writers[t] = initx.NewWriter(brokers, t)
+		kafkaBreakers[t] = handler.NewBreaker("kafka:"+t, breakers)
+	}
 	rStatus := initx.NewReader(brokers, os.Getenv("GROUP_STATUS"), os.Getenv("TOPIC_STATUS"))
+	// status offsets are only committed once the event is applied or parked
+	// in the DLQ, so there is no running without one
+	tDLQ := os.Getenv("TOPIC_STATUS_DLQ")
+	if tDLQ == "" {
+		fatal("TOPIC_STATUS_DLQ", errors.New("not set"))
+	}
+	wStatusDLQ := initx.NewWriter(brokers, tDLQ)
 
 	cmAddr := os.Getenv("CLIENT_MANAGER_GRPC_ADDR")
-	grpcConn, err := initx.NewGRPCClient(cmAddr)
+	cmBreaker := handler.NewBreaker("client-manager", breakers)
+	cmTimeout := time.Duration(atoi64(os.Getenv("CLIENT_MANAGER_TIMEOUT_MS"))) * time.Millisecond
+	grpcConn, err := initx.NewGRPCClient(cmAddr, cmBreaker.UnaryClientInterceptor(cmTimeout))
 	if err != nil {
-		log.Fatal("grpc dial:", err)
+		fatal("grpc dial", err)
 	}
 	defer grpcConn.Close()
 
@@ -39,23 +92,117 @@ func main() {
 	priceNormal := atoi64(os.Getenv("PRICE_NORMAL"))
 	pricePriority := atoi64(os.Getenv("PRICE_PRIORITY"))
 
-	api := handler.NewAPI(db, wNormal, wPriority, rStatus, cmClient, priceNormal, pricePriority)
-	go api.PublishMessage()
+	api := handler.NewAPI(db, routing, writers, rStatus, cmClient, priceNormal, pricePriority)
+	api.AdminToken = os.Getenv("ADMIN_TOKEN")
+	switch api.AdminToken {
+	case "":
+		slog.Warn("ADMIN_TOKEN not set; admin endpoints disabled")
+	case "change-me":
+		fatal("ADMIN_TOKEN", errors.New("still the old placeholder; set a secret or leave it empty"))
+	}
+	api.CMBreaker = cmBreaker
+	api.KafkaBreakers = kafkaBreakers
+	if n := int(atoi64(os.Getenv("PUBLISH_QUEUE_SIZE"))); n > 0 {
+		api.ReadyQ = make(chan handler.Message, n)
+	}
+	api.WStatusDLQ = wStatusDLQ
+	api.ReservationTTL = seconds("RESERVATION_TTL_SEC")
+	api.ShortLinkBase = os.Getenv("SHORT_LINK_BASE")
+	api.Reconcile = handler.ReconcileConfig{
+		Interval:    seconds("RECONCILE_INTERVAL_SEC"),
+		CreatedSLA:  seconds("SLA_CREATED_SEC"),
+		QueuedSLA:   seconds("SLA_QUEUED_SEC"),
+		AcceptedSLA: seconds("SLA_ACCEPTED_SEC"),
+		BatchSize:   int(atoi64(os.Getenv("RECONCILE_BATCH"))),
+	}
+	api.Retention = handler.RetentionConfig{
+		Interval:    seconds("RETENTION_INTERVAL_SEC"),
+		DefaultDays: int(atoi64(os.Getenv("RETENTION_DAYS"))),
+		BatchSize:   int(atoi64(os.Getenv("RETENTION_BATCH"))),
+	}
+	api.Publish = handler.PublishConfig{
+		BatchSize: int(atoi64(os.Getenv("PUBLISH_BATCH_SIZE"))),
+		Linger:    time.Duration(atoi64(os.Getenv("PUBLISH_LINGER_MS"))) * time.Millisecond,
+	}
+	api.FairQueue = handler.FairQueueConfig{
+		Rate:      float64(atoi64(os.Getenv("FAIR_QUEUE_RATE"))),
+		WeightTTL: seconds("QUEUE_WEIGHT_TTL_SEC"),
+
+		MaxDepth:       int(atoi64(os.Getenv("FAIR_QUEUE_MAX"))),
+		MaxClientDepth: int(atoi64(os.Getenv("FAIR_QUEUE_CLIENT_MAX"))),
+	}
 	if err := api.AutoMigrate(); err != nil {
-		log.Fatal("migrate:", err)
+		fatal("migrate", err)
 	}
-	api.StartStatusConsumer(context.Background())
-	r := gin.Default()
+	bg, stopBg := context.WithCancel(context.Background())
+	api.StartPublisher()
+	api.StartFairQueue(bg)
+	api.StartStatusConsumer(bg)
+	api.StartReconciler(bg)
+	api.StartArchiver(bg)
+	r := gin.New()
+	r.Use(gin.Recovery(), otelgin.Middleware("message-manager"), logging.Gin())
 	api.RegisterRoutes(r)
+	if err := handler.CheckContract(r); err != nil {
+		// go test catches drift; a running server keeps serving
+		slog.Error("openapi contract", "err", err)
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	log.Println("massage-manager listening on :" + port)
-	if err := r.Run("0.0.0.0:" + port); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{Addr: "0.0.0.0:" + port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("http serve", err)
+		}
+	}()
+
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "9092"
+	}
+	lis, err := net.Listen("tcp", "0.0.0.0:"+grpcPort)
+	if err != nil {
+		fatal("grpc listen", err)
 	}
+	gs := grpc.NewServer(grpcserver.ServerOptions()...)
+	grpcserver.Register(gs, api)
+	go func() {
+		if err := gs.Serve(lis); err != nil {
+			fatal("grpc serve", err)
+		}
+	}()
+	api.SetReady(true)
+	slog.Info("massage-manager listening", "port", port, "grpc_port", grpcPort)
+
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down")
+
+	// fail readiness first and keep serving briefly so the gateway notices
+	api.SetReady(false)
+	time.Sleep(seconds("SHUTDOWN_DELAY_SEC"))
+
+	timeout := seconds("SHUTDOWN_TIMEOUT_SEC")
+	if timeout <= 0 {
+		timeout = 25 * time.Second
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		slog.Warn("http shutdown", "err", err)
+	}
+	stopGRPC(sctx, gs)
+	stopBg()
+	if err := api.Shutdown(sctx); err != nil {
+		slog.Warn("shutdown", "err", err)
+	}
+	if err := flushTraces(sctx); err != nil {
+		slog.Warn("flush traces", "err", err)
+	}
+	slog.Info("massage-manager stopped")
 }
 
 // tiny helper (avoid importing strconv here)
@@ -69,3 +216,39 @@ func atoi64(s string) int64 {
 	}
 	return n
 }
+
+// loadRouting reads the routing classes from ROUTING_CLASSES_FILE, or
+// falls back to NORMAL and PRIORITY on TOPIC_NORMAL and TOPIC_PRIORITY.
+func loadRouting() (*handler.Routing, error) {
+	path := os.Getenv("ROUTING_CLASSES_FILE")
+	if path == "" {
+		return handler.LegacyRouting(os.Getenv("TOPIC_NORMAL"), os.Getenv("TOPIC_PRIORITY"))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return handler.ParseRouting(data)
+}
+
+// stopGRPC lets in-flight calls finish; status watchers are cut off when
+// ctx expires.
+func stopGRPC(ctx context.Context, gs *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		gs.Stop()
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func seconds(key string) time.Duration { return time.Duration(atoi64(os.Getenv(key))) * time.Second }
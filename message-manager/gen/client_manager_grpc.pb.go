@@ -22,8 +22,12 @@ type ClientManagerClient interface {
 	CreateClient(ctx context.Context, in *CreateClientRequest, opts ...grpc.CallOption) (*CreateClientResponse, error)
 	GetClient(ctx context.Context, in *GetClientRequest, opts ...grpc.CallOption) (*GetClientResponse, error)
 	GetPricePlan(ctx context.Context, in *GetPricePlanRequest, opts ...grpc.CallOption) (*GetPricePlanResponse, error)
+	SetQueueWeight(ctx context.Context, in *SetQueueWeightRequest, opts ...grpc.CallOption) (*GetClientResponse, error)
 	Debit(ctx context.Context, in *MoneyRequest, opts ...grpc.CallOption) (*MoneyResponse, error)
 	Refund(ctx context.Context, in *MoneyRequest, opts ...grpc.CallOption) (*MoneyResponse, error)
+	Reserve(ctx context.Context, in *ReserveRequest, opts ...grpc.CallOption) (*ReservationResponse, error)
+	Capture(ctx context.Context, in *SettleRequest, opts ...grpc.CallOption) (*ReservationResponse, error)
+	Release(ctx context.Context, in *SettleRequest, opts ...grpc.CallOption) (*ReservationResponse, error)
 }
 
 type clientManagerClient struct {
@@ -70,6 +74,15 @@ func (c *clientManagerClient) GetPricePlan(ctx context.Context, in *GetPricePlan
 	return out, nil
 }
 
+func (c *clientManagerClient) SetQueueWeight(ctx context.Context, in *SetQueueWeightRequest, opts ...grpc.CallOption) (*GetClientResponse, error) {
+	out := new(GetClientResponse)
+	err := c.cc.Invoke(ctx, "/client_manager.v1.ClientManager/SetQueueWeight", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *clientManagerClient) Debit(ctx context.Context, in *MoneyRequest, opts ...grpc.CallOption) (*MoneyResponse, error) {
 	out := new(MoneyResponse)
 	err := c.cc.Invoke(ctx, "/client_manager.v1.ClientManager/Debit", in, out, opts...)
@@ -88,6 +101,33 @@ func (c *clientManagerClient) Refund(ctx context.Context, in *MoneyRequest, opts
 	return out, nil
 }
 
+func (c *clientManagerClient) Reserve(ctx context.Context, in *ReserveRequest, opts ...grpc.CallOption) (*ReservationResponse, error) {
+	out := new(ReservationResponse)
+	err := c.cc.Invoke(ctx, "/client_manager.v1.ClientManager/Reserve", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientManagerClient) Capture(ctx context.Context, in *SettleRequest, opts ...grpc.CallOption) (*ReservationResponse, error) {
+	out := new(ReservationResponse)
+	err := c.cc.Invoke(ctx, "/client_manager.v1.ClientManager/Capture", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *clientManagerClient) Release(ctx context.Context, in *SettleRequest, opts ...grpc.CallOption) (*ReservationResponse, error) {
+	out := new(ReservationResponse)
+	err := c.cc.Invoke(ctx, "/client_manager.v1.ClientManager/Release", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ClientManagerServer is the server API for ClientManager service.
 // All implementations must embed UnimplementedClientManagerServer
 // for forward compatibility
@@ -96,8 +136,12 @@ type ClientManagerServer interface {
 	CreateClient(context.Context, *CreateClientRequest) (*CreateClientResponse, error)
 	GetClient(context.Context, *GetClientRequest) (*GetClientResponse, error)
 	GetPricePlan(context.Context, *GetPricePlanRequest) (*GetPricePlanResponse, error)
+	SetQueueWeight(context.Context, *SetQueueWeightRequest) (*GetClientResponse, error)
 	Debit(context.Context, *MoneyRequest) (*MoneyResponse, error)
 	Refund(context.Context, *MoneyRequest) (*MoneyResponse, error)
+	Reserve(context.Context, *ReserveRequest) (*ReservationResponse, error)
+	Capture(context.Context, *SettleRequest) (*ReservationResponse, error)
+	Release(context.Context, *SettleRequest) (*ReservationResponse, error)
 	mustEmbedUnimplementedClientManagerServer()
 }
 
@@ -117,12 +161,24 @@ func (UnimplementedClientManagerServer) GetClient(context.Context, *GetClientReq
 func (UnimplementedClientManagerServer) GetPricePlan(context.Context, *GetPricePlanRequest) (*GetPricePlanResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetPricePlan not implemented")
 }
+func (UnimplementedClientManagerServer) SetQueueWeight(context.Context, *SetQueueWeightRequest) (*GetClientResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetQueueWeight not implemented")
+}
 func (UnimplementedClientManagerServer) Debit(context.Context, *MoneyRequest) (*MoneyResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Debit not implemented")
 }
 func (UnimplementedClientManagerServer) Refund(context.Context, *MoneyRequest) (*MoneyResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Refund not implemented")
 }
+func (UnimplementedClientManagerServer) Reserve(context.Context, *ReserveRequest) (*ReservationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reserve not implemented")
+}
+func (UnimplementedClientManagerServer) Capture(context.Context, *SettleRequest) (*ReservationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Capture not implemented")
+}
+func (UnimplementedClientManagerServer) Release(context.Context, *SettleRequest) (*ReservationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
 func (UnimplementedClientManagerServer) mustEmbedUnimplementedClientManagerServer() {}
 
 // UnsafeClientManagerServer may be embedded to opt out of forward compatibility for this service.
@@ -208,6 +264,24 @@ func _ClientManager_GetPricePlan_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ClientManager_SetQueueWeight_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetQueueWeightRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientManagerServer).SetQueueWeight(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/client_manager.v1.ClientManager/SetQueueWeight",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientManagerServer).SetQueueWeight(ctx, req.(*SetQueueWeightRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _ClientManager_Debit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(MoneyRequest)
 	if err := dec(in); err != nil {
@@ -244,6 +318,60 @@ func _ClientManager_Refund_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ClientManager_Reserve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReserveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientManagerServer).Reserve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/client_manager.v1.ClientManager/Reserve",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientManagerServer).Reserve(ctx, req.(*ReserveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientManager_Capture_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SettleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientManagerServer).Capture(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/client_manager.v1.ClientManager/Capture",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientManagerServer).Capture(ctx, req.(*SettleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ClientManager_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SettleRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ClientManagerServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/client_manager.v1.ClientManager/Release",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ClientManagerServer).Release(ctx, req.(*SettleRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // ClientManager_ServiceDesc is the grpc.ServiceDesc for ClientManager service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -267,6 +395,10 @@ var ClientManager_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetPricePlan",
 			Handler:    _ClientManager_GetPricePlan_Handler,
 		},
+		{
+			MethodName: "SetQueueWeight",
+			Handler:    _ClientManager_SetQueueWeight_Handler,
+		},
 		{
 			MethodName: "Debit",
 			Handler:    _ClientManager_Debit_Handler,
@@ -275,6 +407,18 @@ var ClientManager_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Refund",
 			Handler:    _ClientManager_Refund_Handler,
 		},
+		{
+			MethodName: "Reserve",
+			Handler:    _ClientManager_Reserve_Handler,
+		},
+		{
+			MethodName: "Capture",
+			Handler:    _ClientManager_Capture_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _ClientManager_Release_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "client_manager.proto",
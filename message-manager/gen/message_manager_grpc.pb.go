@@ -0,0 +1,273 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package client_manager
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// MessageManagerClient is the client API for MessageManager service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MessageManagerClient interface {
+	SendMessage(ctx context.Context, in *SendMessageRequest, opts ...grpc.CallOption) (*SendMessageResponse, error)
+	SendBatch(ctx context.Context, in *SendBatchRequest, opts ...grpc.CallOption) (*SendBatchResponse, error)
+	GetMessage(ctx context.Context, in *GetMessageRequest, opts ...grpc.CallOption) (*MessageRecord, error)
+	ListMessages(ctx context.Context, in *ListMessagesRequest, opts ...grpc.CallOption) (*ListMessagesResponse, error)
+	WatchStatuses(ctx context.Context, in *WatchStatusesRequest, opts ...grpc.CallOption) (MessageManager_WatchStatusesClient, error)
+}
+
+type messageManagerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMessageManagerClient(cc grpc.ClientConnInterface) MessageManagerClient {
+	return &messageManagerClient{cc}
+}
+
+func (c *messageManagerClient) SendMessage(ctx context.Context, in *SendMessageRequest, opts ...grpc.CallOption) (*SendMessageResponse, error) {
+	out := new(SendMessageResponse)
+	err := c.cc.Invoke(ctx, "/message_manager.v1.MessageManager/SendMessage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageManagerClient) SendBatch(ctx context.Context, in *SendBatchRequest, opts ...grpc.CallOption) (*SendBatchResponse, error) {
+	out := new(SendBatchResponse)
+	err := c.cc.Invoke(ctx, "/message_manager.v1.MessageManager/SendBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageManagerClient) GetMessage(ctx context.Context, in *GetMessageRequest, opts ...grpc.CallOption) (*MessageRecord, error) {
+	out := new(MessageRecord)
+	err := c.cc.Invoke(ctx, "/message_manager.v1.MessageManager/GetMessage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageManagerClient) ListMessages(ctx context.Context, in *ListMessagesRequest, opts ...grpc.CallOption) (*ListMessagesResponse, error) {
+	out := new(ListMessagesResponse)
+	err := c.cc.Invoke(ctx, "/message_manager.v1.MessageManager/ListMessages", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *messageManagerClient) WatchStatuses(ctx context.Context, in *WatchStatusesRequest, opts ...grpc.CallOption) (MessageManager_WatchStatusesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MessageManager_ServiceDesc.Streams[0], "/message_manager.v1.MessageManager/WatchStatuses", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &messageManagerWatchStatusesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MessageManager_WatchStatusesClient interface {
+	Recv() (*StatusUpdate, error)
+	grpc.ClientStream
+}
+
+type messageManagerWatchStatusesClient struct {
+	grpc.ClientStream
+}
+
+func (x *messageManagerWatchStatusesClient) Recv() (*StatusUpdate, error) {
+	m := new(StatusUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MessageManagerServer is the server API for MessageManager service.
+// All implementations must embed UnimplementedMessageManagerServer
+// for forward compatibility
+type MessageManagerServer interface {
+	SendMessage(context.Context, *SendMessageRequest) (*SendMessageResponse, error)
+	SendBatch(context.Context, *SendBatchRequest) (*SendBatchResponse, error)
+	GetMessage(context.Context, *GetMessageRequest) (*MessageRecord, error)
+	ListMessages(context.Context, *ListMessagesRequest) (*ListMessagesResponse, error)
+	WatchStatuses(*WatchStatusesRequest, MessageManager_WatchStatusesServer) error
+	mustEmbedUnimplementedMessageManagerServer()
+}
+
+// UnimplementedMessageManagerServer must be embedded to have forward compatible implementations.
+type UnimplementedMessageManagerServer struct {
+}
+
+func (UnimplementedMessageManagerServer) SendMessage(context.Context, *SendMessageRequest) (*SendMessageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMessage not implemented")
+}
+func (UnimplementedMessageManagerServer) SendBatch(context.Context, *SendBatchRequest) (*SendBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendBatch not implemented")
+}
+func (UnimplementedMessageManagerServer) GetMessage(context.Context, *GetMessageRequest) (*MessageRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMessage not implemented")
+}
+func (UnimplementedMessageManagerServer) ListMessages(context.Context, *ListMessagesRequest) (*ListMessagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMessages not implemented")
+}
+func (UnimplementedMessageManagerServer) WatchStatuses(*WatchStatusesRequest, MessageManager_WatchStatusesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchStatuses not implemented")
+}
+func (UnimplementedMessageManagerServer) mustEmbedUnimplementedMessageManagerServer() {}
+
+// UnsafeMessageManagerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MessageManagerServer will
+// result in compilation errors.
+type UnsafeMessageManagerServer interface {
+	mustEmbedUnimplementedMessageManagerServer()
+}
+
+func RegisterMessageManagerServer(s grpc.ServiceRegistrar, srv MessageManagerServer) {
+	s.RegisterService(&MessageManager_ServiceDesc, srv)
+}
+
+func _MessageManager_SendMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageManagerServer).SendMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/message_manager.v1.MessageManager/SendMessage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageManagerServer).SendMessage(ctx, req.(*SendMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageManager_SendBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageManagerServer).SendBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/message_manager.v1.MessageManager/SendBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageManagerServer).SendBatch(ctx, req.(*SendBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageManager_GetMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageManagerServer).GetMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/message_manager.v1.MessageManager/GetMessage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageManagerServer).GetMessage(ctx, req.(*GetMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageManager_ListMessages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMessagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MessageManagerServer).ListMessages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/message_manager.v1.MessageManager/ListMessages",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MessageManagerServer).ListMessages(ctx, req.(*ListMessagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MessageManager_WatchStatuses_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchStatusesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MessageManagerServer).WatchStatuses(m, &messageManagerWatchStatusesServer{stream})
+}
+
+type MessageManager_WatchStatusesServer interface {
+	Send(*StatusUpdate) error
+	grpc.ServerStream
+}
+
+type messageManagerWatchStatusesServer struct {
+	grpc.ServerStream
+}
+
+func (x *messageManagerWatchStatusesServer) Send(m *StatusUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// MessageManager_ServiceDesc is the grpc.ServiceDesc for MessageManager service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MessageManager_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "message_manager.v1.MessageManager",
+	HandlerType: (*MessageManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendMessage",
+			Handler:    _MessageManager_SendMessage_Handler,
+		},
+		{
+			MethodName: "SendBatch",
+			Handler:    _MessageManager_SendBatch_Handler,
+		},
+		{
+			MethodName: "GetMessage",
+			Handler:    _MessageManager_GetMessage_Handler,
+		},
+		{
+			MethodName: "ListMessages",
+			Handler:    _MessageManager_ListMessages_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchStatuses",
+			Handler:       _MessageManager_WatchStatuses_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "message_manager.proto",
+}
@@ -0,0 +1,216 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	mmpb "message-manager/gen"
+	"message-manager/handler"
+	"message-manager/logging"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// maxBatch caps SendBatch; larger batches must be split by the caller.
+const maxBatch = 500
+
+type Server struct {
+	mmpb.UnimplementedMessageManagerServer
+	api *handler.API
+}
+
+func New(api *handler.API) *Server { return &Server{api: api} }
+
+func Register(s *grpc.Server, api *handler.API) {
+	mmpb.RegisterMessageManagerServer(s, New(api))
+}
+
+// ServerOptions traces, logs and authenticates every call.
+func ServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(logging.UnaryServer, authUnary),
+		grpc.ChainStreamInterceptor(logging.StreamServer, authStream),
+	}
+}
+
+type clientIDKey struct{}
+
+// authenticate reads the caller's client ID from the x-client-id metadata
+// key, the gRPC counterpart of the X-Client-ID header.
+func authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ids := md.Get("x-client-id")
+	if len(ids) == 0 || ids[0] == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing x-client-id")
+	}
+	return context.WithValue(ctx, clientIDKey{}, ids[0]), nil
+}
+
+func authUnary(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return next(ctx, req)
+}
+
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authedStream) Context() context.Context { return s.ctx }
+
+func authStream(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+	ctx, err := authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return next(srv, authedStream{ServerStream: ss, ctx: ctx})
+}
+
+func clientID(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDKey{}).(string)
+	return id
+}
+
+func (s *Server) SendMessage(ctx context.Context, req *mmpb.SendMessageRequest) (*mmpb.SendMessageResponse, error) {
+	m, err := s.api.Send(ctx, clientID(ctx), createRequest(req))
+	if err != nil {
+		return nil, sendError(err)
+	}
+	return &mmpb.SendMessageResponse{Id: strconv.Itoa(m.ID), Status: m.Status}, nil
+}
+
+// SendBatch sends each message independently; one refused message does not
+// stop the others. Results are in request order.
+func (s *Server) SendBatch(ctx context.Context, req *mmpb.SendBatchRequest) (*mmpb.SendBatchResponse, error) {
+	if len(req.GetMessages()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "messages required")
+	}
+	if len(req.GetMessages()) > maxBatch {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d messages per batch", maxBatch)
+	}
+	id := clientID(ctx)
+	resp := &mmpb.SendBatchResponse{Results: make([]*mmpb.BatchItemResult, 0, len(req.Messages))}
+	for i, r := range req.Messages {
+		res := &mmpb.BatchItemResult{Index: int32(i)}
+		m, err := s.api.Send(ctx, id, createRequest(r))
+		var se *handler.SendError
+		switch {
+		case err == nil:
+			res.Id, res.Status = strconv.Itoa(m.ID), m.Status
+		case errors.As(err, &se):
+			res.Error, res.Detail = se.Code, se.Detail
+		default:
+			res.Error, res.Detail = "internal_error", err.Error()
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	return resp, nil
+}
+
+func (s *Server) GetMessage(ctx context.Context, req *mmpb.GetMessageRequest) (*mmpb.MessageRecord, error) {
+	m, err := s.api.GetClientMessage(clientID(ctx), req.GetId())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, status.Error(codes.NotFound, "not_found")
+		}
+		return nil, status.Errorf(codes.Internal, "db: %v", err)
+	}
+	return record(m), nil
+}
+
+func (s *Server) ListMessages(ctx context.Context, req *mmpb.ListMessagesRequest) (*mmpb.ListMessagesResponse, error) {
+	msgs, f, err := s.api.ListMessages(clientID(ctx), handler.ListFilter{
+		Limit: int(req.GetLimit()), Page: int(req.GetPage()), Type: req.GetType(), Status: req.GetStatus(),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "db: %v", err)
+	}
+	resp := &mmpb.ListMessagesResponse{Page: int32(f.Page), Limit: int32(f.Limit), Count: int32(len(msgs))}
+	for _, m := range msgs {
+		resp.Items = append(resp.Items, record(m))
+	}
+	return resp, nil
+}
+
+// WatchStatuses streams the caller's status changes as they are committed
+// on this instance, until the client goes away.
+func (s *Server) WatchStatuses(req *mmpb.WatchStatusesRequest, stream mmpb.MessageManager_WatchStatusesServer) error {
+	ctx := stream.Context()
+	only := map[string]bool{}
+	for _, id := range req.GetMessageIds() {
+		only[id] = true
+	}
+	ch, unsubscribe := s.api.Subscribe(clientID(ctx))
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case sc, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if len(only) > 0 && !only[sc.MessageID] {
+				continue
+			}
+			if err := stream.Send(&mmpb.StatusUpdate{
+				MessageId: sc.MessageID,
+				Status:    sc.Status,
+				Operator:  sc.Operator,
+				AtUnixMs:  sc.At.UnixMilli(),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func createRequest(r *mmpb.SendMessageRequest) handler.CreateMessageRequest {
+	return handler.CreateMessageRequest{
+		From: r.GetFrom(), To: handler.Recipients{r.GetTo()}, Body: r.GetBody(), Type: r.GetType(),
+		ShortenURLs: r.GetShortenUrls(), Campaign: r.GetCampaign(),
+	}
+}
+
+func record(m handler.Message) *mmpb.MessageRecord {
+	return &mmpb.MessageRecord{
+		Id: strconv.Itoa(m.ID), ClientId: m.ClientID, From: m.From, To: m.To, Body: m.Body,
+		Type: m.Type, PriceMinor: m.PriceMinor, Status: m.Status, Operator: m.Operator, Campaign: m.Campaign,
+		CreatedAtUnix: m.CreatedAt.Unix(), UpdatedAtUnix: m.UpdatedAt.Unix(),
+	}
+}
+
+// sendError maps a refusal from handler.Send to a gRPC status; the code
+// string is kept as the message so clients can switch on it.
+func sendError(err error) error {
+	var se *handler.SendError
+	if !errors.As(err, &se) {
+		return status.Errorf(codes.Internal, "send: %v", err)
+	}
+	msg := se.Code
+	if se.Detail != "" {
+		msg += ": " + se.Detail
+	}
+	switch se.Status {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, msg)
+	case http.StatusPaymentRequired, http.StatusUnprocessableEntity:
+		return status.Error(codes.FailedPrecondition, msg)
+	case http.StatusForbidden:
+		return status.Error(codes.PermissionDenied, msg)
+	case http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, msg)
+	}
+	return status.Error(codes.Internal, msg)
+}
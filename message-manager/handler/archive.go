@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"message-manager/logging"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageArchive is one batch of a client's messages moved out of the
+// messages table, stored as gzipped JSON lines. A period (the UTC month
+// the messages were created in, e.g. "2026-05") usually spans several
+// archives.
+//
+// Archived rows keep Body and To exactly as stored, so encrypted rows stay
+// encrypted: a KEK must stay in the keyring while archives still use it.
+type MessageArchive struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	ClientID  string    `gorm:"size:64;index:idx_archive_client_period" json:"client_id"`
+	Period    string    `gorm:"size:7;index:idx_archive_client_period" json:"period"`
+	Count     int       `json:"count"`
+	FirstID   int       `json:"first_id"`
+	LastID    int       `json:"last_id"`
+	SizeBytes int       `json:"size_bytes"`
+	Data      []byte    `gorm:"size:16777215" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ArchiveList struct {
+	Items []MessageArchive `json:"items"`
+}
+
+type RestoreArchiveResponse struct {
+	Period   string `json:"period"`
+	Restored int    `json:"restored"`
+}
+
+// RetentionConfig drives the archiver. DefaultDays applies to clients
+// without a retention setting of their own; 0 keeps their messages
+// forever. Interval 0 disables archiving.
+type RetentionConfig struct {
+	Interval    time.Duration
+	DefaultDays int
+	BatchSize   int
+}
+
+// archivedMessage is a message as written to an archive: the stored row,
+// including the columns the API never shows.
+type archivedMessage struct {
+	Message
+	ReservationID string `json:"reservation_id,omitempty"`
+	TraceParent   string `json:"trace_parent,omitempty"`
+	KeyID         string `json:"key_id,omitempty"`
+	WrappedKey    string `json:"wrapped_key,omitempty"`
+	ToHash        string `json:"to_hash,omitempty"`
+}
+
+func archived(m Message) archivedMessage {
+	return archivedMessage{Message: m, ReservationID: m.ReservationID, TraceParent: m.TraceParent,
+		KeyID: m.KeyID, WrappedKey: m.WrappedKey, ToHash: m.ToHash}
+}
+
+func (am archivedMessage) message() Message {
+	m := am.Message
+	m.ReservationID, m.TraceParent = am.ReservationID, am.TraceParent
+	m.KeyID, m.WrappedKey, m.ToHash = am.KeyID, am.WrappedKey, am.ToHash
+	return m
+}
+
+var finalStatuses = []string{"DELIVERED", "FAILED", "EXPIRED", "REJECTED", "CANCELED"}
+
+func archivePeriod(t time.Time) string { return t.UTC().Format("2006-01") }
+
+// StartArchiver periodically archives and purges finalized messages that
+// are past their client's retention.
+func (a *API) StartArchiver(ctx context.Context) {
+	if a.Retention.Interval <= 0 {
+		return
+	}
+	a.bg.Add(1)
+	go func() {
+		defer a.bg.Done()
+		t := time.NewTicker(a.Retention.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				a.archiveOnce(ctx)
+			}
+		}
+	}()
+}
+
+func (a *API) archiveOnce(ctx context.Context) {
+	var overrides []ClientSetting
+	if err := a.DB.Where("retention_days > 0").Find(&overrides).Error; err != nil {
+		slog.Error("archive settings scan failed", "err", err)
+		return
+	}
+	days := map[string]int{}
+	minDays := a.Retention.DefaultDays
+	for _, s := range overrides {
+		days[s.ClientID] = s.RetentionDays
+		if minDays <= 0 || s.RetentionDays < minDays {
+			minDays = s.RetentionDays
+		}
+	}
+	if minDays <= 0 {
+		return
+	}
+
+	now := time.Now()
+	clients, err := a.Messages.ArchivableClients(ctx, now.AddDate(0, 0, -minDays), 1000)
+	if err != nil {
+		slog.Error("archive scan failed", "err", err)
+		return
+	}
+	for _, clientID := range clients {
+		d, ok := days[clientID]
+		if !ok {
+			d = a.Retention.DefaultDays
+		}
+		if d <= 0 {
+			continue
+		}
+		cutoff := now.AddDate(0, 0, -d)
+		for ctx.Err() == nil {
+			n, err := a.archiveBatch(ctx, clientID, cutoff)
+			if err != nil {
+				slog.Error("archive batch failed", logging.ClientID, clientID, "err", err)
+				break
+			}
+			if n > 0 {
+				messagesArchived.Add(float64(n))
+				slog.Info("messages archived", logging.ClientID, clientID, "count", n)
+			}
+			if n < a.archiveBatchSize() {
+				break
+			}
+		}
+	}
+}
+
+func (a *API) archiveBatchSize() int {
+	if a.Retention.BatchSize > 0 {
+		return a.Retention.BatchSize
+	}
+	return 500
+}
+
+// archiveBatch moves up to one batch of clientID's messages older than
+// cutoff into archives, one per period, and deletes them, all in one
+// transaction. Rows are archived as stored.
+func (a *API) archiveBatch(ctx context.Context, clientID string, cutoff time.Time) (int, error) {
+	n := 0
+	err := a.Messages.Tx(ctx, func(tx *MessageTx) error {
+		msgs, err := tx.Archivable(clientID, cutoff, a.archiveBatchSize())
+		if err != nil || len(msgs) == 0 {
+			return err
+		}
+		var order []string
+		byPeriod := map[string][]Message{}
+		for _, m := range msgs {
+			p := archivePeriod(m.CreatedAt)
+			if _, ok := byPeriod[p]; !ok {
+				order = append(order, p)
+			}
+			byPeriod[p] = append(byPeriod[p], m)
+		}
+		ids := make([]int, 0, len(msgs))
+		for _, p := range order {
+			group := byPeriod[p]
+			data, err := encodeArchive(group)
+			if err != nil {
+				return err
+			}
+			if err := tx.db.Create(&MessageArchive{
+				ClientID: clientID, Period: p, Count: len(group),
+				FirstID: group[0].ID, LastID: group[len(group)-1].ID,
+				SizeBytes: len(data), Data: data,
+			}).Error; err != nil {
+				return err
+			}
+			for _, m := range group {
+				ids = append(ids, m.ID)
+			}
+		}
+		if err := tx.db.Where("message_id IN ?", ids).Delete(&MessageTerm{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(ids); err != nil {
+			return err
+		}
+		n = len(ids)
+		return nil
+	})
+	return n, err
+}
+
+func encodeArchive(msgs []Message) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, m := range msgs {
+		if err := enc.Encode(archived(m)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeArchive(data []byte) ([]Message, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var msgs []Message
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var am archivedMessage
+		if err := dec.Decode(&am); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, am.message())
+	}
+	return msgs, nil
+}
+
+func (a *API) periodArchives(clientID, period string) ([]MessageArchive, error) {
+	var arcs []MessageArchive
+	err := a.DB.Where("client_id = ? AND period = ?", clientID, period).Order("first_id").Find(&arcs).Error
+	return arcs, err
+}
+
+// ArchivedMessages returns a page of clientID's archived messages created
+// in period, decrypted and masked like ListMessages.
+func (a *API) ArchivedMessages(clientID, period string, limit, page int) ([]Message, error) {
+	arcs, err := a.periodArchives(clientID, period)
+	if err != nil {
+		return nil, err
+	}
+	skip := page * limit
+	var out []Message
+	for _, arc := range arcs {
+		if skip >= arc.Count {
+			skip -= arc.Count
+			continue
+		}
+		msgs, err := decodeArchive(arc.Data)
+		if err != nil {
+			return nil, fmt.Errorf("archive %d: %w", arc.ID, err)
+		}
+		for _, m := range msgs[skip:] {
+			if err := m.AfterFind(a.DB); err != nil {
+				return nil, err
+			}
+			out = append(out, m)
+			if len(out) == limit {
+				return out, a.maskBodies(clientID, out)
+			}
+		}
+		skip = 0
+	}
+	return out, a.maskBodies(clientID, out)
+}
+
+// RestoreArchive moves clientID's archived messages for period back into
+// the messages table and drops the archives. Restored rows get a fresh
+// updated_at, so they stay for a full retention period before the
+// archiver picks them up again.
+func (a *API) RestoreArchive(clientID, period string) (int, error) {
+	n := 0
+	err := a.Messages.Tx(context.Background(), func(tx *MessageTx) error {
+		var arcs []MessageArchive
+		if err := tx.db.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("client_id = ? AND period = ?", clientID, period).Find(&arcs).Error; err != nil {
+			return err
+		}
+		if len(arcs) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		now := time.Now()
+		for _, arc := range arcs {
+			msgs, err := decodeArchive(arc.Data)
+			if err != nil {
+				return fmt.Errorf("archive %d: %w", arc.ID, err)
+			}
+			for i := range msgs {
+				msgs[i].UpdatedAt = now
+			}
+			restored, err := tx.Restore(msgs)
+			if err != nil {
+				return err
+			}
+			n += restored
+			for _, m := range msgs {
+				if err := m.AfterFind(tx.db); err != nil {
+					return err
+				}
+				if err := indexMessage(tx.db, &m); err != nil {
+					return err
+				}
+			}
+			if err := tx.db.Delete(&MessageArchive{}, arc.ID).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func archivePeriodParam(c *gin.Context) (string, bool) {
+	p := c.Param("period")
+	if _, err := time.Parse("2006-01", p); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_period", Detail: "period must be YYYY-MM"})
+		return "", false
+	}
+	return p, true
+}
+
+// ListArchives lists the caller's archives, optionally of one ?period=.
+func (a *API) ListArchives(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	q := a.DB.Where("client_id = ?", clientID)
+	if p := c.Query("period"); p != "" {
+		q = q.Where("period = ?", p)
+	}
+	arcs := []MessageArchive{}
+	if err := q.Omit("data").Order("period, first_id").Find(&arcs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ArchiveList{Items: arcs})
+}
+
+func (a *API) ListArchivedMessages(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	period, ok := archivePeriodParam(c)
+	if !ok {
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	page, _ := strconv.Atoi(c.Query("page"))
+	if page < 0 {
+		page = 0
+	}
+	msgs, err := a.ArchivedMessages(clientID, period, limit, page)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "archive_error", Detail: err.Error()})
+		return
+	}
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	c.JSON(http.StatusOK, MessageList{Items: msgs, Page: page, Limit: limit, Count: len(msgs)})
+}
+
+func (a *API) RestoreArchiveHandler(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	period, ok := archivePeriodParam(c)
+	if !ok {
+		return
+	}
+	n, err := a.RestoreArchive(clientID, period)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, ErrorResponse{Error: "restore_failed", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, RestoreArchiveResponse{Period: period, Restored: n})
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	clientpb "message-manager/gen"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errReservationClosed = errors.New("reservation_closed")
+
+// settlements maps a status to what happens to the message's money once
+// it is reached: the reservation is captured on delivery and released on
+// every other final status.
+var settlements = map[string]string{
+	"DELIVERED": "CAPTURE",
+	"FAILED":    "RELEASE",
+	"EXPIRED":   "RELEASE",
+	"REJECTED":  "RELEASE",
+	"CANCELED":  "RELEASE",
+}
+
+// newReservationRef returns a random ref for a reservation.
+func newReservationRef() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// reserve holds amount of clientID's balance for ref. Free messages (a
+// class priced at 0) need no hold and get no reservation ID.
+func (a *API) reserve(ctx context.Context, clientID string, amount int64, ref string) (string, error) {
+	if amount <= 0 {
+		return "", nil
+	}
+	if a.CM == nil {
+		return "", fmt.Errorf("client-manager grpc client not set")
+	}
+	resp, err := a.CM.Reserve(ctx, &clientpb.ReserveRequest{
+		ClientId:    clientID,
+		AmountMinor: amount,
+		Ref:         ref,
+		TtlSec:      int64(a.ReservationTTL / time.Second),
+	})
+	observeBilling("reserve", err)
+	if err != nil {
+		if st, ok := status.FromError(err); ok && st.Code() == codes.FailedPrecondition {
+			return "", errInsufficientFunds
+		}
+		if unavailable(err) {
+			return "", unavailableError("billing_unavailable", status.Convert(err).Message(), a.CMBreaker.RetryAfter())
+		}
+		return "", err
+	}
+	return resp.GetReservation().GetReservationId(), nil
+}
+
+func (a *API) capture(ctx context.Context, clientID, resID string, amount int64, ref string) error {
+	if a.CM == nil {
+		return fmt.Errorf("client-manager grpc client not set")
+	}
+	return settle(ctx, "capture", a.CM.Capture, clientID, resID, amount, ref)
+}
+
+func (a *API) release(ctx context.Context, clientID, resID string, amount int64, ref string) error {
+	if a.CM == nil {
+		return fmt.Errorf("client-manager grpc client not set")
+	}
+	return settle(ctx, "release", a.CM.Release, clientID, resID, amount, ref)
+}
+
+type settleRPC func(context.Context, *clientpb.SettleRequest, ...grpc.CallOption) (*clientpb.ReservationResponse, error)
+
+func settle(ctx context.Context, op string, rpc settleRPC, clientID, resID string, amount int64, ref string) error {
+	_, err := rpc(ctx, &clientpb.SettleRequest{ClientId: clientID, ReservationId: resID, AmountMinor: amount, Ref: ref})
+	observeBilling(op, err)
+	if st, ok := status.FromError(err); ok && st.Code() == codes.FailedPrecondition {
+		return errReservationClosed
+	}
+	return err
+}
+
+// settleOnce captures or releases msg's money for its new status, unless
+// that has happened before. It must run inside the transaction that moved
+// msg to that status, so that a failed call rolls the status change back.
+func (a *API) settleOnce(ctx context.Context, tx *MessageTx, msg *Message) error {
+	kind, ok := settlements[msg.Status]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if first, err := tx.MarkSettled(msg.ID, now); err != nil || !first {
+		return err
+	}
+	msg.SettledAt = &now
+	if msg.PriceMinor <= 0 {
+		return nil // nothing was reserved or debited
+	}
+	ref := msgRef(msg.ID)
+
+	if msg.ReservationID == "" {
+		// debited up front before reservations existed
+		if kind == "CAPTURE" {
+			return nil
+		}
+		if err := a.recordEvent(tx.db, msg.ID, "REFUND", msg.Status, msg.Status, fmt.Sprintf("%d minor units", msg.PriceMinor)); err != nil {
+			return err
+		}
+		_, err := a.refund(ctx, msg.ClientID, msg.PriceMinor, ref)
+		return err
+	}
+
+	if err := a.recordEvent(tx.db, msg.ID, kind, msg.Status, msg.Status, fmt.Sprintf("%d minor units", msg.PriceMinor)); err != nil {
+		return err
+	}
+	if kind == "RELEASE" {
+		err := a.release(ctx, msg.ClientID, msg.ReservationID, msg.PriceMinor, ref)
+		if errors.Is(err, errReservationClosed) {
+			return nil // already released on expiry
+		}
+		return err
+	}
+	err := a.capture(ctx, msg.ClientID, msg.ReservationID, msg.PriceMinor, ref)
+	if !errors.Is(err, errReservationClosed) {
+		return err
+	}
+	// the reservation expired before delivery was confirmed: charge directly
+	if _, err := a.debit(ctx, msg.ClientID, msg.PriceMinor, ref); err != nil {
+		if errors.Is(err, errInsufficientFunds) {
+			return a.recordEvent(tx.db, msg.ID, "SETTLE_FAILED", msg.Status, msg.Status, "reservation expired and balance is insufficient")
+		}
+		return err
+	}
+	return nil
+}
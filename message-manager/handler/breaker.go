@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BreakerConfig is shared by the circuit breakers: a breaker opens after
+// Failures consecutive failures and lets one trial call through once
+// Cooldown has passed.
+type BreakerConfig struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var errBreakerOpen = errors.New("circuit open")
+
+// Breaker is a circuit breaker around one dependency. A nil *Breaker lets
+// every call through.
+type Breaker struct {
+	Name string
+	cfg  BreakerConfig
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool // the half-open trial call is in flight
+}
+
+func NewBreaker(name string, cfg BreakerConfig) *Breaker {
+	if cfg.Failures <= 0 {
+		cfg.Failures = 5
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 10 * time.Second
+	}
+	b := &Breaker{Name: name, cfg: cfg, state: BreakerClosed}
+	breakerState.WithLabelValues(name).Set(0)
+	return b
+}
+
+// Allow reports whether a call may go ahead; every allowed call must be
+// followed by Done.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			return false
+		}
+		b.set(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+	}
+	return true
+}
+
+// Done records the outcome of an allowed call.
+func (b *Breaker) Done(ok bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if ok {
+		b.failures = 0
+		b.set(BreakerClosed)
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.cfg.Failures {
+		b.openedAt = time.Now()
+		b.set(BreakerOpen)
+	}
+}
+
+func (b *Breaker) set(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	v := map[string]float64{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}[state]
+	breakerState.WithLabelValues(b.Name).Set(v)
+}
+
+// State is the breaker's state; an open breaker whose cooldown has passed
+// reports half-open.
+func (b *Breaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cfg.Cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// RetryAfter is how long until an open breaker lets a trial call through,
+// rounded up to whole seconds and at least 1.
+func (b *Breaker) RetryAfter() int {
+	if b == nil {
+		return 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	left := b.cfg.Cooldown - time.Since(b.openedAt)
+	if b.state != BreakerOpen || left <= 0 {
+		return 1
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
+
+// UnaryClientInterceptor guards a gRPC connection with b and gives calls
+// without a deadline one of timeout. Only errors that say the server is
+// unreachable or overloaded count as failures; refusals such as
+// insufficient funds are answers.
+func (b *Breaker) UnaryClientInterceptor(timeout time.Duration) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !b.Allow() {
+			return status.Error(codes.Unavailable, errBreakerOpen.Error())
+		}
+		if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		b.Done(!unavailable(err))
+		return err
+	}
+}
+
+// unavailable reports whether err means a gRPC dependency could not
+// answer.
+func unavailable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// BreakerStates maps every breaker's name to its state.
+func (a *API) BreakerStates() map[string]string {
+	states := map[string]string{}
+	if a.CMBreaker != nil {
+		states[a.CMBreaker.Name] = a.CMBreaker.State()
+	}
+	for _, b := range a.KafkaBreakers {
+		states[b.Name] = b.State()
+	}
+	return states
+}
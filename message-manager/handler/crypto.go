@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gorm.io/gorm"
+)
+
+// Keyring holds the key-encryption keys (KEKs) for message bodies and
+// recipients. Every row gets its own data key (DEK); the DEK is stored
+// wrapped by the active KEK together with that KEK's ID, so rotating means
+// adding a KEK, making it active and rewrapping old rows at leisure.
+type Keyring struct {
+	active   string
+	keks     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+var errUnknownKey = errors.New("unknown_key_id")
+
+// ParseKeyring reads KEKs given as "id:base64,id:base64" (32-byte keys).
+// indexKey keys the blind index of recipients and must never change.
+func ParseKeyring(keks, active string, indexKey []byte) (*Keyring, error) {
+	k := &Keyring{active: active, keks: map[string]cipher.AEAD{}, indexKey: indexKey}
+	for _, part := range strings.Split(keks, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, b64, ok := strings.Cut(part, ":")
+		if !ok || id == "" || len(id) > 32 {
+			return nil, fmt.Errorf("kek %q: want id:base64", part)
+		}
+		raw, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("kek %s: want 32 base64-encoded bytes", id)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		k.keks[id] = aead
+	}
+	if _, ok := k.keks[active]; !ok {
+		return nil, fmt.Errorf("active kek %q not in keyring", active)
+	}
+	if len(indexKey) < 16 {
+		return nil, errors.New("index key must be at least 16 bytes")
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain, ad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plain, ad)
+}
+
+func open(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:n], sealed[n:], ad)
+}
+
+// blindIndex is a keyed hash of a normalized recipient, so rows can be
+// looked up by recipient without storing it in the clear.
+func (k *Keyring) blindIndex(to string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(normalizeRecipient(to)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func normalizeRecipient(to string) string {
+	return strings.TrimPrefix(strings.TrimSpace(to), "+")
+}
+
+func (k *Keyring) wrap(dek []byte) (string, error) {
+	return base64.StdEncoding.EncodeToString(seal(k.keks[k.active], dek, []byte(k.active))), nil
+}
+
+func (k *Keyring) unwrap(keyID, wrapped string) (cipher.AEAD, []byte, error) {
+	kek, ok := k.keks[keyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", errUnknownKey, keyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, nil, err
+	}
+	dek, err := open(kek, raw, []byte(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dek)
+	return aead, dek, err
+}
+
+// sealMessage encrypts m's Body and To in place under a fresh DEK.
+func (k *Keyring) sealMessage(m *Message) error {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return err
+	}
+	wrapped, err := k.wrap(dek)
+	if err != nil {
+		return err
+	}
+	m.ToHash = k.blindIndex(m.To)
+	m.Body = base64.StdEncoding.EncodeToString(seal(aead, []byte(m.Body), []byte("body")))
+	m.To = base64.StdEncoding.EncodeToString(seal(aead, []byte(m.To), []byte("to")))
+	m.KeyID, m.WrappedKey = k.active, wrapped
+	m.sealed = true
+	return nil
+}
+
+func (k *Keyring) openMessage(m *Message) error {
+	aead, _, err := k.unwrap(m.KeyID, m.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("message %d: %w", m.ID, err)
+	}
+	for _, f := range []struct {
+		v  *string
+		ad string
+	}{{&m.Body, "body"}, {&m.To, "to"}} {
+		raw, err := base64.StdEncoding.DecodeString(*f.v)
+		if err != nil {
+			return fmt.Errorf("message %d %s: %w", m.ID, f.ad, err)
+		}
+		plain, err := open(aead, raw, []byte(f.ad))
+		if err != nil {
+			return fmt.Errorf("message %d %s: %w", m.ID, f.ad, err)
+		}
+		*f.v = string(plain)
+	}
+	m.sealed = false
+	return nil
+}
+
+var keyring atomic.Pointer[Keyring]
+
+// SetKeyring turns encryption at rest on for messages written from now
+// on. Without a keyring messages are stored in plaintext; rows written
+// with one can then no longer be read.
+func SetKeyring(k *Keyring) { keyring.Store(k) }
+
+// The hooks below keep Body and To encrypted in the database and in the
+// clear in memory. Updates that touch neither column skip encryption.
+
+func (m *Message) BeforeSave(tx *gorm.DB) error {
+	k := keyring.Load()
+	if k == nil || m.sealed || (m.Body == "" && m.To == "") {
+		return nil
+	}
+	return k.sealMessage(m)
+}
+
+func (m *Message) AfterSave(tx *gorm.DB) error {
+	if !m.sealed {
+		return nil
+	}
+	return keyring.Load().openMessage(m)
+}
+
+func (m *Message) AfterFind(tx *gorm.DB) error {
+	if m.KeyID == "" {
+		return nil // written before encryption was turned on
+	}
+	k := keyring.Load()
+	if k == nil {
+		return fmt.Errorf("message %d: %w: %s (no keyring)", m.ID, errUnknownKey, m.KeyID)
+	}
+	return k.openMessage(m)
+}
+
+// RewrapKeys moves up to limit messages onto the active KEK: rows sealed
+// under an older KEK get their DEK rewrapped (the ciphertext is not
+// touched) and plaintext rows from before encryption are sealed. It
+// returns how many rows it changed; call it until that is zero.
+func (a *API) RewrapKeys(limit int) (int, error) {
+	k := keyring.Load()
+	if k == nil {
+		return 0, errors.New("encryption at rest is not configured")
+	}
+	rows, err := a.Messages.NotUnderKey(context.Background(), k.active, limit)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, r := range rows {
+		var err error
+		if r.KeyID == "" {
+			err = a.sealLegacy(k, r.ID)
+		} else {
+			err = a.rewrap(k, r.ID, r.KeyID, r.WrappedKey)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (a *API) rewrap(k *Keyring, id int, keyID, wrapped string) error {
+	_, dek, err := k.unwrap(keyID, wrapped)
+	if err != nil {
+		return fmt.Errorf("message %d: %w", id, err)
+	}
+	rewrapped, err := k.wrap(dek)
+	if err != nil {
+		return err
+	}
+	// conditional on the old key so a concurrent save is not overwritten
+	return a.Messages.Rewrap(context.Background(), id, keyID, k.active, rewrapped)
+}
+
+func (a *API) sealLegacy(k *Keyring, id int) error {
+	m, err := a.Messages.Get(context.Background(), "", strconv.Itoa(id))
+	if err != nil {
+		return err
+	}
+	if err := k.sealMessage(&m); err != nil {
+		return err
+	}
+	return a.Messages.Seal(context.Background(), &m)
+}
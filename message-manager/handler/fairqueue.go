@@ -0,0 +1,415 @@
+package handler
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	clientpb "message-manager/gen"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FairQueueConfig controls the fair queue in front of the topics of
+// fair_queue routing classes. Each such topic gets per-client queues that
+// are released to the publisher at Rate messages per second by weighted
+// fair queueing, so a client with a large backlog only delays the others
+// in proportion to its weight. Weights come from client-manager.
+type FairQueueConfig struct {
+	// Rate is per topic and should be about what the topic's workers
+	// sustain: released faster, the backlog builds up in Kafka in FIFO
+	// order instead of here. 0 disables the fair queue.
+	Rate      float64
+	WeightTTL time.Duration // how long a client's weight is cached
+	// MaxDepth and MaxClientDepth bound a topic's queue and each client's
+	// share of it; new messages beyond them are refused with 503. 0 means
+	// unbounded.
+	MaxDepth       int
+	MaxClientDepth int
+}
+
+const (
+	fairTick         = 10 * time.Millisecond
+	defaultWeightTTL = time.Minute
+)
+
+type fairItem struct {
+	m   Message
+	tag float64 // virtual finish time
+	at  time.Time
+}
+
+type clientQueue struct {
+	clientID string
+	items    []fairItem
+	last     float64 // finish tag of the client's last queued message
+	index    int     // in fairQueue.active; -1 when empty
+}
+
+// fairQueue is the weighted fair queue of one topic. A message gets the
+// finish tag max(V, last) + 1/weight, where V is the tag of the message
+// released last, and the lowest head tag is released first.
+type fairQueue struct {
+	topic             string
+	maxDepth, maxEach int
+
+	mu      sync.Mutex
+	clients map[string]*clientQueue
+	active  queueHeap // clients with queued messages, by head tag
+	vtime   float64
+	ids     map[int]bool
+}
+
+func newFairQueue(topic string, maxDepth, maxEach int) *fairQueue {
+	return &fairQueue{topic: topic, maxDepth: maxDepth, maxEach: maxEach, clients: map[string]*clientQueue{}, ids: map[int]bool{}}
+}
+
+// excess is by how many messages n more from clientID would overrun the
+// queue's bounds; 0 when they fit.
+func (q *fairQueue) excess(clientID string, n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	over := 0
+	if q.maxDepth > 0 {
+		over = len(q.ids) + n - q.maxDepth
+	}
+	if cq := q.clients[clientID]; q.maxEach > 0 {
+		mine := n
+		if cq != nil {
+			mine += len(cq.items)
+		}
+		over = max(over, mine-q.maxEach)
+	}
+	return max(0, over)
+}
+
+// push queues m unless it already is; the reconciler may hand over a
+// message still waiting here. It reports false when m does not fit.
+func (q *fairQueue) push(m Message, weight int32) bool {
+	if weight < 1 {
+		weight = 1
+	}
+	if q.excess(m.ClientID, 1) > 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ids[m.ID] {
+		return true
+	}
+	cq := q.clients[m.ClientID]
+	if cq == nil {
+		cq = &clientQueue{clientID: m.ClientID, index: -1}
+		q.clients[m.ClientID] = cq
+	}
+	tag := max(q.vtime, cq.last) + 1/float64(weight)
+	cq.last = tag
+	cq.items = append(cq.items, fairItem{m: m, tag: tag, at: time.Now()})
+	q.ids[m.ID] = true
+	if cq.index < 0 {
+		heap.Push(&q.active, cq)
+	}
+	fairQueueDepth.WithLabelValues(q.topic).Inc()
+	return true
+}
+
+func (q *fairQueue) pop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.active) == 0 {
+		return Message{}, false
+	}
+	cq := q.active[0]
+	it := cq.items[0]
+	cq.items[0] = fairItem{}
+	cq.items = cq.items[1:]
+	q.vtime = it.tag
+	delete(q.ids, it.m.ID)
+	if len(cq.items) == 0 {
+		heap.Pop(&q.active)
+		// an idle client starts over at V; its old tags would penalize it
+		delete(q.clients, cq.clientID)
+	} else {
+		heap.Fix(&q.active, cq.index)
+	}
+	fairQueueDepth.WithLabelValues(q.topic).Dec()
+	return it.m, true
+}
+
+func (q *fairQueue) holds(id int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.ids[id]
+}
+
+// run releases messages at rate per second, while room reports space in
+// the publish queue, until ctx is done or release reports the publisher
+// closed. Unused capacity accrues for up to a tenth of a second.
+func (q *fairQueue) run(ctx context.Context, rate float64, room func() bool, release func(Message) bool) {
+	t := time.NewTicker(fairTick)
+	defer t.Stop()
+	burst := max(1, rate/10)
+	credit, last := 0.0, time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			credit = min(burst, credit+rate*now.Sub(last).Seconds())
+			last = now
+			for credit >= 1 && room() {
+				m, ok := q.pop()
+				if !ok {
+					break
+				}
+				credit--
+				if !release(m) {
+					return
+				}
+			}
+		}
+	}
+}
+
+type queueHeap []*clientQueue
+
+func (h queueHeap) Len() int           { return len(h) }
+func (h queueHeap) Less(i, j int) bool { return h[i].items[0].tag < h[j].items[0].tag }
+func (h queueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *queueHeap) Push(x any) {
+	cq := x.(*clientQueue)
+	cq.index = len(*h)
+	*h = append(*h, cq)
+}
+func (h *queueHeap) Pop() any {
+	old := *h
+	cq := old[len(old)-1]
+	old[len(old)-1] = nil
+	cq.index = -1
+	*h = old[:len(old)-1]
+	return cq
+}
+
+// StartFairQueue sets up a fair queue for every fair_queue topic of the
+// routing config and releases them until ctx is canceled. The queues live
+// in memory only: messages left in them at shutdown stay CREATED, and the
+// next start loads them back.
+func (a *API) StartFairQueue(ctx context.Context) {
+	if a.FairQueue.Rate <= 0 {
+		return
+	}
+	a.fair = map[string]*fairQueue{}
+	for _, topic := range a.Routing.FairTopics() {
+		a.fair[topic] = newFairQueue(topic, a.FairQueue.MaxDepth, a.FairQueue.MaxClientDepth)
+	}
+	// before anything is released or sent, so no message is queued twice
+	a.reloadFairQueues(ctx)
+	for _, q := range a.fair {
+		a.bg.Add(1)
+		go func() {
+			defer a.bg.Done()
+			q.run(ctx, a.FairQueue.Rate, a.publishRoom, func(m Message) bool { return a.toPublisher(m, true) })
+		}()
+	}
+}
+
+// reloadFairQueues queues the CREATED messages of fair-queued classes, in
+// the order they were stored. Those that do not fit stay CREATED for the
+// reconciler. It must run before the HTTP server starts.
+func (a *API) reloadFairQueues(ctx context.Context) {
+	const batch = 500
+	loaded, skipped, after := 0, 0, 0
+	for ctx.Err() == nil {
+		msgs, err := a.Messages.Find(ctx, MessageQuery{Status: "CREATED", AfterID: after, Order: ByID, Limit: batch})
+		if err != nil {
+			slog.Error("fair queue reload failed", "err", err)
+			return
+		}
+		for _, m := range msgs {
+			after = m.ID
+			q := a.fairQueueFor(m)
+			if q == nil {
+				continue
+			}
+			if q.push(m, a.queueWeight(m.ClientID)) {
+				loaded++
+			} else {
+				skipped++
+			}
+		}
+		if len(msgs) < batch {
+			break
+		}
+	}
+	if loaded+skipped > 0 {
+		slog.Info("fair queue reloaded", "messages", loaded, "skipped", skipped)
+	}
+}
+
+// fairQueueFor returns the fair queue m's class is released through, or
+// nil when it goes straight to the publisher.
+func (a *API) fairQueueFor(m Message) *fairQueue {
+	if a.fair == nil {
+		return nil
+	}
+	c := a.Routing.Class(m.Type)
+	if c == nil || !c.FairQueue {
+		return nil
+	}
+	return a.fair[c.Topic]
+}
+
+// fairQueued reports whether message id is waiting in a fair queue.
+func (a *API) fairQueued(id int) bool {
+	for _, q := range a.fair {
+		if q.holds(id) {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedWeight struct {
+	weight int32
+	at     time.Time
+}
+
+// queueWeight is clientID's weight from client-manager, cached for
+// FairQueue.WeightTTL. Clients it cannot look up weigh 1.
+func (a *API) queueWeight(clientID string) int32 {
+	ttl := a.FairQueue.WeightTTL
+	if ttl <= 0 {
+		ttl = defaultWeightTTL
+	}
+	a.weightMu.Lock()
+	w, ok := a.weights[clientID]
+	a.weightMu.Unlock()
+	if ok && time.Since(w.at) < ttl {
+		return w.weight
+	}
+	weight := int32(1)
+	if a.CM != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		resp, err := a.CM.GetClient(ctx, &clientpb.GetClientRequest{ClientId: clientID})
+		cancel()
+		switch {
+		case err != nil:
+			slog.Warn("queue weight lookup failed", "client_id", clientID, "err", err)
+			if ok {
+				return w.weight // keep the stale one rather than reset it
+			}
+		case resp.GetClient().GetQueueWeight() > 0:
+			weight = resp.GetClient().GetQueueWeight()
+		}
+	}
+	a.cacheWeight(clientID, weight)
+	return weight
+}
+
+func (a *API) cacheWeight(clientID string, weight int32) {
+	a.weightMu.Lock()
+	defer a.weightMu.Unlock()
+	if a.weights == nil {
+		a.weights = map[string]cachedWeight{}
+	}
+	a.weights[clientID] = cachedWeight{weight: weight, at: time.Now()}
+}
+
+// QueueDepth is one client's backlog in the fair queue of a topic.
+type QueueDepth struct {
+	Topic     string  `json:"topic"`
+	ClientID  string  `json:"client_id"`
+	Depth     int     `json:"depth"`
+	Weight    int32   `json:"weight"`
+	OldestSec float64 `json:"oldest_sec"` // age of the client's oldest queued message
+}
+
+// QueueDepths lists the fair queues' backlogs, deepest first.
+func (a *API) QueueDepths() []QueueDepth {
+	out := []QueueDepth{}
+	now := time.Now()
+	for topic, q := range a.fair {
+		q.mu.Lock()
+		for id, cq := range q.clients {
+			out = append(out, QueueDepth{Topic: topic, ClientID: id, Depth: len(cq.items), OldestSec: now.Sub(cq.items[0].at).Seconds()})
+		}
+		q.mu.Unlock()
+	}
+	a.weightMu.Lock()
+	for i := range out {
+		out[i].Weight = max(1, a.weights[out[i].ClientID].weight)
+	}
+	a.weightMu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Depth != out[j].Depth {
+			return out[i].Depth > out[j].Depth
+		}
+		if out[i].Topic != out[j].Topic {
+			return out[i].Topic < out[j].Topic
+		}
+		return out[i].ClientID < out[j].ClientID
+	})
+	return out
+}
+
+// ListQueues serves GET /admin/queues[?client_id=].
+func (a *API) ListQueues(c *gin.Context) {
+	depths := a.QueueDepths()
+	if id := c.Query("client_id"); id != "" {
+		mine := []QueueDepth{}
+		for _, d := range depths {
+			if d.ClientID == id {
+				mine = append(mine, d)
+			}
+		}
+		depths = mine
+	}
+	total := 0
+	for _, d := range depths {
+		total += d.Depth
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": a.fair != nil, "total": total, "items": depths})
+}
+
+type SetQueueWeightRequest struct {
+	QueueWeight int32 `json:"queue_weight" binding:"required"`
+}
+
+// SetQueueWeight serves PUT /admin/queues/:client_id/weight. The weight is
+// stored in client-manager and applies to messages queued from now on.
+func (a *API) SetQueueWeight(c *gin.Context) {
+	var req SetQueueWeightRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if a.CM == nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "client-manager grpc client not set"})
+		return
+	}
+	clientID := c.Param("client_id")
+	resp, err := a.CM.SetQueueWeight(c.Request.Context(), &clientpb.SetQueueWeightRequest{ClientId: clientID, QueueWeight: req.QueueWeight})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument:
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_queue_weight", Detail: status.Convert(err).Message()})
+		case codes.NotFound:
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "client_not_found"})
+		default:
+			c.JSON(http.StatusBadGateway, ErrorResponse{Error: "client_manager_error", Detail: err.Error()})
+		}
+		return
+	}
+	weight := resp.GetClient().GetQueueWeight()
+	a.cacheWeight(clientID, weight)
+	c.JSON(http.StatusOK, gin.H{"client_id": clientID, "queue_weight": weight})
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	initx "message-manager/init"
+
+	"gorm.io/gorm/logger"
+)
+
+// TestFairQueueReload checks that CREATED messages of fair-queued classes
+// left over from a previous run are released again on start.
+func TestFairQueueReload(t *testing.T) {
+	a := newFairTestAPI(t, nil)
+	db := a.DB
+	now := time.Now()
+	msgs := []Message{
+		{ClientID: "c1", To: "+989120000001", Type: "BULK", Status: "CREATED"},
+		{ClientID: "c1", To: "+989120000002", Type: "BULK", Status: "QUEUED"},
+		{ClientID: "c2", To: "+989120000003", Type: "OTP", Status: "CREATED"},
+		{ClientID: "c2", To: "+989120000004", Type: "BULK", Status: "HELD"},
+		{ClientID: "c2", To: "+989120000005", Type: "BULK", Status: "CREATED"},
+	}
+	for i := range msgs {
+		msgs[i].CreatedAt, msgs[i].UpdatedAt = now, now
+	}
+	if err := db.Create(&msgs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.StartFairQueue(ctx)
+	got := map[int]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(got) < 2 {
+		select {
+		case m := <-a.ReadyQ:
+			got[m.ID] = true
+		case <-timeout:
+			t.Fatalf("released %v, want messages %d and %d", got, msgs[0].ID, msgs[4].ID)
+		}
+	}
+	if !got[msgs[0].ID] || !got[msgs[4].ID] {
+		t.Fatalf("released %v, want messages %d and %d", got, msgs[0].ID, msgs[4].ID)
+	}
+}
+
+// newFairTestAPI is an API over a fresh SQLite database with a fair-queued
+// BULK class and a plain OTP class.
+func newFairTestAPI(t *testing.T, writers map[string]TopicWriter) *API {
+	t.Helper()
+	db, err := initx.OpenDB("sqlite://" + t.TempDir() + "/mm.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent)
+	routing, err := NewRouting("BULK", []RoutingClass{
+		{Name: "BULK", Topic: "sms.bulk.v1", PriceColumn: PriceColumnNormal, FairQueue: true},
+		{Name: "OTP", Topic: "sms.otp.v1", PriceColumn: PriceColumnPriority},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAPI(db, routing, writers, nil, nil, 1, 1)
+	a.FairQueue = FairQueueConfig{Rate: 1000}
+	if err := a.AutoMigrate(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
@@ -0,0 +1,340 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// FilterRule is a content rule checked against every message body.
+// An empty ClientID makes the rule global.
+type FilterRule struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	ClientID  string    `gorm:"index" json:"client_id"`
+	Kind      string    `json:"kind"` // KEYWORD|REGEX|DOMAIN
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"` // ALLOW|BLOCK|HOLD
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+
+	re *regexp.Regexp // Pattern compiled, for REGEX rules
+}
+
+type CreateFilterRuleRequest struct {
+	ClientID string `json:"client_id"`
+	Kind     string `json:"kind" binding:"required"`
+	Pattern  string `json:"pattern" binding:"required"`
+	Action   string `json:"action" binding:"required"`
+	Note     string `json:"note"`
+}
+
+const (
+	ActionAllow = "ALLOW"
+	ActionBlock = "BLOCK"
+	ActionHold  = "HOLD"
+)
+
+var actionRank = map[string]int{ActionAllow: 0, ActionHold: 1, ActionBlock: 2}
+
+var domainRe = regexp.MustCompile(`(?i)\b(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})\b`)
+
+// matches reports whether the rule fires for body. domains are the
+// lower-cased host names found in body.
+func (r FilterRule) matches(body string, domains []string) bool {
+	switch r.Kind {
+	case "KEYWORD":
+		return strings.Contains(strings.ToLower(body), strings.ToLower(r.Pattern))
+	case "REGEX":
+		return r.re != nil && r.re.MatchString(body)
+	case "DOMAIN":
+		p := strings.ToLower(strings.TrimPrefix(r.Pattern, "."))
+		for _, d := range domains {
+			if d == p || strings.HasSuffix(d, "."+p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func bodyDomains(body string) []string {
+	var out []string
+	for _, m := range domainRe.FindAllStringSubmatch(body, -1) {
+		out = append(out, strings.ToLower(m[1]))
+	}
+	return out
+}
+
+// ruleCacheTTL bounds how long a rule created or deleted on another
+// instance takes to apply here; this instance drops its cache at once.
+const ruleCacheTTL = 30 * time.Second
+
+// ruleSet is every filter rule, compiled, by client ID; "" holds the
+// global ones.
+type ruleSet struct {
+	byClient map[string][]FilterRule
+	at       time.Time
+}
+
+// filterRules returns clientID's rules followed by the global ones, from
+// the cache when it is fresh.
+func (a *API) filterRules(clientID string) ([]FilterRule, error) {
+	a.rulesMu.Lock()
+	defer a.rulesMu.Unlock()
+	if a.rules == nil || time.Since(a.rules.at) >= ruleCacheTTL {
+		var all []FilterRule
+		if err := a.DB.Find(&all).Error; err != nil {
+			return nil, err
+		}
+		set := &ruleSet{byClient: map[string][]FilterRule{}, at: time.Now()}
+		for _, r := range all {
+			if r.Kind == "REGEX" {
+				// checked on create; a bad one in the table never matches
+				r.re, _ = regexp.Compile(r.Pattern)
+			}
+			set.byClient[r.ClientID] = append(set.byClient[r.ClientID], r)
+		}
+		a.rules = set
+	}
+	own, global := a.rules.byClient[clientID], a.rules.byClient[""]
+	if clientID == "" {
+		own = nil
+	}
+	return append(append(make([]FilterRule, 0, len(own)+len(global)), own...), global...), nil
+}
+
+// dropFilterRules makes the next check reload the rules.
+func (a *API) dropFilterRules() {
+	a.rulesMu.Lock()
+	a.rules = nil
+	a.rulesMu.Unlock()
+}
+
+// checkContent evaluates the filter rules for a message body.
+// Client rules are consulted first: if any of them match, the most severe
+// of those decides, so a client ALLOW can whitelist past global rules.
+// Otherwise the most severe matching global rule decides. No match allows.
+func (a *API) checkContent(clientID, body string) (string, *FilterRule, error) {
+	rules, err := a.filterRules(clientID)
+	if err != nil {
+		return "", nil, err
+	}
+	domains := bodyDomains(body)
+	pick := func(scope func(FilterRule) bool) (string, *FilterRule) {
+		var hit *FilterRule
+		for i := range rules {
+			r := rules[i]
+			if !scope(r) || !r.matches(body, domains) {
+				continue
+			}
+			if hit == nil || actionRank[r.Action] > actionRank[hit.Action] {
+				hit = &rules[i]
+			}
+		}
+		if hit == nil {
+			return "", nil
+		}
+		return hit.Action, hit
+	}
+	if act, r := pick(func(r FilterRule) bool { return r.ClientID == clientID }); r != nil {
+		return act, r, nil
+	}
+	if act, r := pick(func(r FilterRule) bool { return r.ClientID == "" }); r != nil {
+		return act, r, nil
+	}
+	return ActionAllow, nil, nil
+}
+
+// requireAdmin guards the admin API; without an AdminToken it is off.
+func (a *API) requireAdmin(c *gin.Context) {
+	if a.AdminToken == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, ErrorResponse{Error: "not_found", Detail: "admin API disabled"})
+		return
+	}
+	tok := c.GetHeader("X-Admin-Token")
+	if subtle.ConstantTimeCompare([]byte(tok), []byte(a.AdminToken)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "unauthorized"})
+		return
+	}
+	c.Next()
+}
+
+func (a *API) ListFilterRules(c *gin.Context) {
+	q := a.DB.Order("id")
+	if v, ok := c.GetQuery("client_id"); ok {
+		q = q.Where("client_id = ?", v)
+	}
+	var rules []FilterRule
+	if err := q.Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": rules, "count": len(rules)})
+}
+
+func (a *API) CreateFilterRule(c *gin.Context) {
+	var req CreateFilterRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	r := FilterRule{
+		ClientID:  strings.TrimSpace(req.ClientID),
+		Kind:      strings.ToUpper(req.Kind),
+		Pattern:   req.Pattern,
+		Action:    strings.ToUpper(req.Action),
+		Note:      req.Note,
+		CreatedAt: time.Now(),
+	}
+	switch r.Kind {
+	case "KEYWORD", "DOMAIN":
+	case "REGEX":
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_regex", Detail: err.Error()})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "kind must be KEYWORD, REGEX or DOMAIN"})
+		return
+	}
+	if _, ok := actionRank[r.Action]; !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "action must be ALLOW, BLOCK or HOLD"})
+		return
+	}
+	if err := a.DB.Create(&r).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	a.dropFilterRules()
+	c.JSON(http.StatusCreated, r)
+}
+
+func (a *API) DeleteFilterRule(c *gin.Context) {
+	res := a.DB.Delete(&FilterRule{}, "id = ?", c.Param("id"))
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
+		return
+	}
+	a.dropFilterRules()
+	c.Status(http.StatusNoContent)
+}
+
+// ListReviewQueue returns held messages, oldest first.
+func (a *API) ListReviewQueue(c *gin.Context) {
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 500 {
+			limit = n
+		}
+	}
+	msgs, err := a.Messages.Find(c.Request.Context(), MessageQuery{Status: "HELD", ClientID: c.Query("client_id"), Order: OldestFirst, Limit: limit})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": msgs, "count": len(msgs)})
+}
+
+// takeHeld moves a HELD message to the given status under a row lock and
+// runs then, if set, in the same transaction. With a clientID, another
+// client's message is not found, whatever its status.
+func (a *API) takeHeld(clientID, id, to string, then func(tx *MessageTx, msg *Message) error) (Message, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return Message{}, gorm.ErrRecordNotFound
+	}
+	msg, err := a.Messages.Transition(context.Background(), n, func(tx *MessageTx, msg *Message) error {
+		if clientID != "" && msg.ClientID != clientID {
+			return gorm.ErrRecordNotFound
+		}
+		if msg.Status != "HELD" || !canTransition(msg.Status, to) {
+			return errNotHeld
+		}
+		msg.Status = to
+		msg.UpdatedAt = time.Now()
+		if err := tx.Save(msg); err != nil {
+			return err
+		}
+		if err := rollStats(tx.db, msg, "HELD", msg.Operator); err != nil {
+			return err
+		}
+		if then != nil {
+			return then(tx, msg)
+		}
+		return nil
+	})
+	if err == nil {
+		a.notify(msg)
+	}
+	return msg, err
+}
+
+func (a *API) ApproveHeld(c *gin.Context) {
+	msg, err := a.takeHeld("", c.Param("id"), "CREATED", nil)
+	if err != nil {
+		a.reviewError(c, err)
+		return
+	}
+	a.enqueue(msg)
+	c.JSON(http.StatusOK, CreateMessageResponse{ID: strconv.Itoa(msg.ID), Status: msg.Status})
+}
+
+func (a *API) RejectHeld(c *gin.Context) {
+	msg, err := a.takeHeld("", c.Param("id"), "REJECTED", func(tx *MessageTx, msg *Message) error {
+		return a.settleOnce(c.Request.Context(), tx, msg)
+	})
+	if err != nil {
+		a.reviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, CreateMessageResponse{ID: strconv.Itoa(msg.ID), Status: msg.Status})
+}
+
+// CancelHeld lets a client withdraw its own message while it waits for
+// review; the reservation is released.
+func (a *API) CancelHeld(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	msg, err := a.takeHeld(clientID, c.Param("id"), "CANCELED", func(tx *MessageTx, msg *Message) error {
+		return a.settleOnce(c.Request.Context(), tx, msg)
+	})
+	if err != nil {
+		a.reviewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, CreateMessageResponse{ID: strconv.Itoa(msg.ID), Status: msg.Status})
+}
+
+func (a *API) reviewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
+	case errors.Is(err, errNotHeld):
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "not_held"})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+	}
+}
+
+func blockedDetail(r *FilterRule) string {
+	if r == nil {
+		return ""
+	}
+	return fmt.Sprintf("rule %d", r.ID)
+}
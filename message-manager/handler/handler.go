@@ -2,45 +2,84 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"log"
 	clientpb "message-manager/gen"
 	"net/http"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/segmentio/kafka-go"
 	"gorm.io/gorm"
-	"gorm.io/gorm/clause"
 )
 
 type Message struct {
-	ID         int       `gorm:"primaryKey" json:"id"`
-	ClientID   string    `json:"client_id"`
-	To         string    `json:"to"`
-	Body       string    `json:"body"`
-	Type       string    `json:"type"`
-	PriceMinor int64     `json:"price_minor"`
-	Status     string    `json:"status"`
-	Operator   string    `json:"operator"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         int        `gorm:"primaryKey" json:"id"`
+	ClientID   string     `gorm:"size:64;index:idx_messages_client_created,priority:1" json:"client_id"`
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	Body       string     `json:"body"`
+	Type       string     `json:"type"`
+	PriceMinor int64      `json:"price_minor"`
+	Status     string     `json:"status"`
+	Operator   string     `json:"operator"`
+	Campaign   string     `gorm:"size:64;index" json:"campaign,omitempty"`
+	HeldByRule *int       `json:"held_by_rule,omitempty"`
+	ParentID   *int       `gorm:"index" json:"parent_id,omitempty"` // MessageRequest of a multi-recipient request
+	StatusAt   *time.Time `json:"status_at,omitempty"`              // At of the last applied status event
+	SettledAt  *time.Time `json:"settled_at,omitempty"`             // set once, guards against double capture/release
+	// ReservationID is the client-manager hold backing PriceMinor; empty
+	// for messages debited before reservations existed.
+	ReservationID string `gorm:"size:32" json:"-"`
+	// ReservationRef is the random ref the reservation was made under;
+	// unlike ID it is never reused, so a retry cannot pick up an old hold.
+	ReservationRef string `gorm:"size:32" json:"-"`
+	// TraceParent links the publish span to the request that created it.
+	TraceParent string `gorm:"size:64" json:"-"`
+	// RequestID is the request that created the message, for log
+	// correlation; it is not stored, so republished messages lack it.
+	RequestID string `gorm:"-" json:"-"`
+	// KeyID and WrappedKey are the KEK and wrapped data key Body and To are
+	// encrypted with; both empty for rows stored in plaintext. ToHash is a
+	// blind index of To.
+	KeyID      string `gorm:"size:32;not null;default:'';index" json:"-"`
+	WrappedKey string `gorm:"size:128" json:"-"`
+	ToHash     string `gorm:"size:64;index" json:"-"`
+	// BodyMasked is set instead of Body when the client hides the bodies
+	// of masked routing classes from API responses.
+	BodyMasked bool      `gorm:"-" json:"body_masked,omitempty"`
+	CreatedAt  time.Time `gorm:"index:idx_messages_client_created,priority:2" json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
+
+	sealed bool // Body and To currently hold ciphertext
 }
 
 type CreateMessageRequest struct {
-	To   string `json:"to" binding:"required"`
-	Body string `json:"body" binding:"required"`
-	Type string `json:"type"` // NORMAL|PRIORITY
+	From string     `json:"from"` // approved sender ID; empty lets the operator pick
+	To   Recipients `json:"to" binding:"required"`
+	Body string     `json:"body" binding:"required"`
+	Type string     `json:"type"` // routing class; empty means the default
+
+	ShortenURLs bool   `json:"shorten_urls"` // rewrite http(s) URLs to tracked short links
+	Campaign    string `json:"campaign"`     // groups click stats across messages
 }
 type CreateMessageResponse struct {
-	ID     string `json:"id"`
+	ID     string `json:"id"` // the parent's ID when there are several recipients
 	Status string `json:"status"`
+	// Messages lists the message of each recipient, in request order, when
+	// there are several.
+	Messages []RecipientResult `json:"messages,omitempty"`
+}
+type MessageList struct {
+	Items []Message `json:"items"`
+	Page  int       `json:"page"`
+	Limit int       `json:"limit"`
+	Count int       `json:"count"`
 }
 type ErrorResponse struct {
 	Error  string `json:"error"`
@@ -71,36 +110,110 @@ type StatusEvent struct {
 
 type API struct {
 	DB            *gorm.DB
-	WNormal       *kafka.Writer
-	WPriority     *kafka.Writer
+	Messages      MessageStore // over DB
+	Routing       *Routing
+	Writers       map[string]TopicWriter // by topic, one per topic of Routing
 	RStatus       *kafka.Reader
+	WStatusDLQ    *kafka.Writer // poison status events end up here
 	HTTP          *http.Client
 	ClientMgrBase string
 	PriceNormal   int64
 	PricePriority int64
 	CM            clientpb.ClientManagerClient
-	ReadyQ        chan Message
+	ReadyQ        chan Message        // must be buffered; senders never block on it
+	CMBreaker     *Breaker            // guards CM; set as its connection's interceptor
+	KafkaBreakers map[string]*Breaker // by topic, around the Writers
+	AdminToken    string
+	ShortLinkBase string // public prefix for short links, e.g. https://sms.example/s/
+	Reconcile     ReconcileConfig
+	Retention     RetentionConfig
+	FairQueue     FairQueueConfig
+	Publish       PublishConfig
+
+	ReservationTTL time.Duration // how long client-manager keeps a hold before auto-release
+
+	hub     statusHub
+	ready   atomic.Bool
+	qmu     sync.RWMutex // guards qclosed against sends on a closed ReadyQ
+	qclosed bool
+	bg      sync.WaitGroup
+	// stopping is closed when Shutdown starts, so sends waiting on a full
+	// ReadyQ give up; pubCtx bounds the publisher's Kafka writes and is
+	// canceled once Shutdown stops waiting for them.
+	stopping chan struct{}
+	stopOnce sync.Once
+	pubCtx   context.Context
+	pubStop  context.CancelFunc
+
+	pub      publishing
+	rulesMu  sync.Mutex
+	rules    *ruleSet              // nil until loaded or after a rule changed
+	fair     map[string]*fairQueue // by topic; nil when the fair queue is off
+	weightMu sync.Mutex
+	weights  map[string]cachedWeight
 }
 
-func NewAPI(db *gorm.DB, wNormal, wPriority *kafka.Writer, rStatus *kafka.Reader, cm clientpb.ClientManagerClient, priceNormal, pricePriority int64) *API {
+// DefaultPublishQueue is the capacity NewAPI gives ReadyQ.
+const DefaultPublishQueue = 1000
+
+func NewAPI(db *gorm.DB, routing *Routing, writers map[string]TopicWriter, rStatus *kafka.Reader, cm clientpb.ClientManagerClient, priceNormal, pricePriority int64) *API {
+	pubCtx, pubStop := context.WithCancel(context.Background())
 	return &API{
-		DB: db, WNormal: wNormal, WPriority: wPriority, RStatus: rStatus,
+		DB: db, Messages: NewMessageStore(db), Routing: routing, Writers: writers, RStatus: rStatus,
 		HTTP:        &http.Client{Timeout: 5 * time.Second},
 		PriceNormal: priceNormal, PricePriority: pricePriority,
-		CM:     cm,
-		ReadyQ: make(chan Message),
+		CM:       cm,
+		ReadyQ:   make(chan Message, DefaultPublishQueue),
+		stopping: make(chan struct{}),
+		pubCtx:   pubCtx, pubStop: pubStop,
 	}
 }
 
 func (a *API) AutoMigrate() error {
-	return a.DB.AutoMigrate(&Message{})
+	return a.DB.AutoMigrate(&Message{}, &FilterRule{}, &Sender{}, &ShortLink{}, &Click{}, &MessageEvent{}, &ClientSetting{}, &MessageArchive{}, &MessageStat{}, &MessageTerm{}, &MessageRequest{})
 }
 
 func (a *API) RegisterRoutes(r *gin.Engine) {
 	r.GET("/healthz", func(c *gin.Context) { c.Status(200) })
+	r.GET("/readyz", a.Readyz)
+	r.GET("/openapi.json", ServeSpec)
+	r.GET("/metrics", ServeMetrics)
+	r.Use(a.validateRequest)
 	r.POST("/messages", a.CreateMessage)
+	r.POST("/messages/quote", a.QuoteMessages)
+	r.GET("/messages/search", a.SearchMyMessages)
+	r.GET("/requests/:id", a.GetRequest)
 	r.GET("/messages", a.ListMyMessages)
 	r.GET("/messages/:id", a.GetMessage)
+	r.GET("/messages/:id/clicks", a.MessageClicks)
+	r.POST("/messages/:id/cancel", a.CancelHeld)
+	r.GET("/campaigns/:campaign/clicks", a.CampaignClicks)
+	r.GET("/s/:code", a.FollowShortLink)
+	r.POST("/senders", a.RegisterSender)
+	r.GET("/senders", a.ListMySenders)
+	r.GET("/settings", a.GetSettings)
+	r.PUT("/settings", a.UpdateSettings)
+	r.GET("/stats", a.GetStats)
+	r.GET("/archives", a.ListArchives)
+	r.GET("/archives/:period/messages", a.ListArchivedMessages)
+	r.POST("/archives/:period/restore", a.RestoreArchiveHandler)
+
+	admin := r.Group("/admin", a.requireAdmin)
+	admin.GET("/rules", a.ListFilterRules)
+	admin.POST("/rules", a.CreateFilterRule)
+	admin.DELETE("/rules/:id", a.DeleteFilterRule)
+	admin.GET("/review", a.ListReviewQueue)
+	admin.POST("/review/:id/approve", a.ApproveHeld)
+	admin.POST("/review/:id/reject", a.RejectHeld)
+	admin.GET("/senders", a.ListSenders)
+	admin.POST("/senders/:id/approve", a.ApproveSender)
+	admin.POST("/senders/:id/reject", a.RejectSender)
+	admin.POST("/keys/rewrap", a.RewrapKeysHandler)
+	admin.POST("/stats/rebuild", a.RebuildStatsHandler)
+	admin.GET("/messages/search", a.AdminSearchMessages)
+	admin.POST("/messages/reindex", a.ReindexMessagesHandler)
+	admin.GET("/queues", a.ListQueues)
+	admin.PUT("/queues/:client_id/weight", a.SetQueueWeight)
 }
 
 func atoi64(s string) int64 { n, _ := strconv.ParseInt(s, 10, 64); return n }
@@ -111,34 +224,16 @@ func runeCount(s string) int {
 	}
 	return n
 }
-func newID() string { return time.Now().UTC().Format("20060102T150405.000000000") }
 
-var errInsufficientFunds = errors.New("insufficient_funds")
+// msgRef is the idempotency ref sent to client-manager for a message.
+func msgRef(id int) string { return strconv.Itoa(id) }
 
-func (a *API) PublishMessage() {
-	for {
-		select {
-		case m := <-a.ReadyQ:
-			val := map[string]any{"message_id": strconv.Itoa(m.ID), "client_id": m.ClientID, "to": m.To, "body": m.Body, "type": m.Type, "price": m.PriceMinor}
-			b, _ := json.Marshal(val)
-			kmsg := kafka.Message{Key: []byte(strconv.Itoa(m.ID)), Value: b, Headers: []kafka.Header{{Key: "x-msg-id", Value: []byte(strconv.Itoa(m.ID))}, {Key: "x-client-id", Value: []byte(m.ClientID)}, {Key: "x-type", Value: []byte(m.Type)}}}
-			w := a.WNormal
-			if m.Type == "PRIORITY" {
-				w = a.WPriority
-			}
-			c := context.Background()
-			if err := w.WriteMessages(c, kmsg); err != nil {
-				_, _ = a.refund(c, m.ClientID, m.PriceMinor, strconv.Itoa(m.ID))
-				return
-			}
-			if err := a.DB.Model(&Message{}).
-				Where("id = ?", m.ID).
-				Update("status", "QUEUED").Error; err != nil {
-				log.Printf("gorm update failed: %v", err)
-			}
-		}
-	}
-}
+func newID() string { return time.Now().UTC().Format("20060102T150405.000000000") }
+
+var (
+	errInsufficientFunds = errors.New("insufficient_funds")
+	errNotHeld           = errors.New("not_held")
+)
 
 func (a *API) debit(ctx context.Context, clientID string, amount int64, ref string) (int64, error) {
 	if a.CM == nil {
@@ -149,6 +244,7 @@ func (a *API) debit(ctx context.Context, clientID string, amount int64, ref stri
 		AmountMinor: amount,
 		Ref:         ref,
 	})
+	observeBilling("debit", err)
 	if err != nil {
 		st, _ := status.FromError(err)
 		if st != nil && st.Code() == codes.FailedPrecondition {
@@ -167,6 +263,7 @@ func (a *API) refund(ctx context.Context, clientID string, amount int64, ref str
 		AmountMinor: amount,
 		Ref:         ref,
 	})
+	observeBilling("refund", err)
 	if err != nil {
 		return 0, err
 	}
@@ -174,6 +271,10 @@ func (a *API) refund(ctx context.Context, clientID string, amount int64, ref str
 }
 
 func (a *API) CreateMessage(c *gin.Context) {
+	start := time.Now()
+	defer func() {
+		createLatency.WithLabelValues(strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}()
 	clientID := c.GetHeader("X-Client-ID")
 	if clientID == "" {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
@@ -184,42 +285,25 @@ func (a *API) CreateMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 		return
 	}
-	if req.Type == "" {
-		req.Type = "NORMAL"
-	}
-	req.Type = strings.ToUpper(req.Type)
-	if req.Type != "NORMAL" && req.Type != "PRIORITY" {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "type must be NORMAL or PRIORITY"})
-		return
-	}
-	if runeCount(req.Body) > 160 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "single-page only (<=160 chars)"})
-		return
-	}
-
-	price := a.PriceNormal
-	if req.Type == "PRIORITY" {
-		price = a.PricePriority
-	}
-
-	if _, err := a.debit(c, clientID, price, ""); err != nil {
-		if errors.Is(err, errInsufficientFunds) {
-			c.JSON(http.StatusPaymentRequired, ErrorResponse{Error: "insufficient_funds"})
+	if len(req.To) > 1 {
+		parent, msgs, err := a.SendMulti(c.Request.Context(), clientID, req)
+		if err != nil {
+			writeError(c, err)
 			return
 		}
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal_error", Detail: err.Error()})
+		resp := CreateMessageResponse{ID: strconv.Itoa(parent.ID), Status: msgs[0].Status}
+		for _, m := range msgs {
+			resp.Messages = append(resp.Messages, RecipientResult{ID: strconv.Itoa(m.ID), To: m.To, Status: m.Status})
+		}
+		c.JSON(http.StatusCreated, resp)
 		return
 	}
-	now := time.Now()
-	m := &Message{ClientID: clientID, To: req.To, Body: req.Body, Type: req.Type, PriceMinor: price, Status: "CREATED", CreatedAt: now, UpdatedAt: now}
-	if err := a.DB.Create(m).Error; err != nil {
-		_, _ = a.refund(c, clientID, price, "")
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal_error", Detail: err.Error()})
+	m, err := a.Send(c.Request.Context(), clientID, req)
+	if err != nil {
+		writeError(c, err)
 		return
 	}
-	a.ReadyQ <- *m
-
-	c.JSON(http.StatusCreated, CreateMessageResponse{ID: strconv.Itoa(m.ID), Status: "CREATED"})
+	c.JSON(http.StatusCreated, CreateMessageResponse{ID: strconv.Itoa(m.ID), Status: m.Status})
 }
 
 func (a *API) ListMyMessages(c *gin.Context) {
@@ -228,112 +312,29 @@ func (a *API) ListMyMessages(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing_client_id", "detail": "X-Client-ID header required"})
 		return
 	}
-	limit := 20
+	f := ListFilter{
+		Type:   c.Query("type"),   // routing class
+		Status: c.Query("status"), // QUEUED|ACCEPTED|...
+	}
 	if v := c.Query("limit"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			if n > 100 {
-				n = 100
-			}
-			limit = n
-		}
+		f.Limit, _ = strconv.Atoi(v)
 	}
-	page := 0
 	if v := c.Query("page"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
-			page = n
-		}
-	}
-	fType := strings.ToUpper(strings.TrimSpace(c.Query("type")))     // NORMAL | PRIORITY
-	fStatus := strings.ToUpper(strings.TrimSpace(c.Query("status"))) // QUEUED|ACCEPTED|...
-
-	q := a.DB.Where("client_id = ?", clientID)
-
-	if fType == "NORMAL" || fType == "PRIORITY" {
-		q = q.Where("type = ?", fType)
-	}
-	switch fStatus {
-	case "QUEUED", "ACCEPTED", "DELIVERED", "FAILED", "EXPIRED":
-		q = q.Where("status = ?", fStatus)
+		f.Page, _ = strconv.Atoi(v)
 	}
-
-	var msgs []Message
-	if err := q.
-		Order("created_at DESC").
-		Limit(limit).
-		Offset(page * limit).
-		Find(&msgs).Error; err != nil {
+	msgs, f, err := a.ListMessages(clientID, f)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error", "detail": err.Error()})
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"items": msgs,
-		"page":  page,
-		"limit": limit,
-		"count": len(msgs),
-	})
+	c.JSON(http.StatusOK, MessageList{Items: msgs, Page: f.Page, Limit: f.Limit, Count: len(msgs)})
 }
 
 func (a *API) GetMessage(c *gin.Context) {
-	id := c.Param("id")
-	var m Message
-	if err := a.DB.First(&m, "id = ?", id).Error; err != nil {
+	m, err := a.GetClientMessage(c.GetHeader("X-Client-ID"), c.Param("id"))
+	if err != nil {
 		c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
 		return
 	}
 	c.JSON(http.StatusOK, m)
 }
-
-func (a *API) StartStatusConsumer(ctx context.Context) {
-	if a.RStatus == nil {
-		return
-	}
-	go func() {
-		defer a.RStatus.Close()
-		for {
-			m, err := a.RStatus.ReadMessage(ctx)
-			if err != nil {
-				if ctx.Err() != nil {
-					return
-				}
-				log.Println("status read err:", err)
-				continue
-			}
-			var evt StatusEvent
-			if err := json.Unmarshal(m.Value, &evt); err != nil {
-				log.Println("status json err:", err)
-				continue
-			}
-			s := strings.ToUpper(evt.Status)
-
-			if err := a.DB.Transaction(func(tx *gorm.DB) error {
-				var msg Message
-				if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&msg, "id = ?", evt.MessageID).Error; err != nil {
-					return err
-				}
-				// final check
-				switch strings.ToUpper(msg.Status) {
-				case "DELIVERED", "FAILED", "EXPIRED":
-					return nil
-				}
-				msg.Status = s
-				if evt.Operator != "" {
-					msg.Operator = evt.Operator
-				}
-				msg.UpdatedAt = time.Now()
-				if err := tx.Save(&msg).Error; err != nil {
-					return err
-				}
-				if s == "FAILED" || s == "EXPIRED" {
-					_, err := a.refund(ctx, msg.ClientID, msg.PriceMinor, "")
-					if err != nil {
-						log.Println("refund error:", err)
-					}
-				}
-				return nil
-			}); err != nil {
-				log.Println("status apply tx err:", err)
-			}
-		}
-	}()
-}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetReady flips the readiness probe. It is cleared first thing on shutdown
+// so load balancers stop routing new requests while in-flight ones drain.
+func (a *API) SetReady(ok bool) { a.ready.Store(ok) }
+
+// ReadyzResponse reports readiness and the circuit breakers. An open
+// breaker makes the service degraded, not unready: every instance shares
+// the dependency, so taking this one out of rotation would not help.
+type ReadyzResponse struct {
+	Status   string            `json:"status"` // ok|degraded|draining
+	Breakers map[string]string `json:"breakers"`
+}
+
+func (a *API) Readyz(c *gin.Context) {
+	resp := ReadyzResponse{Status: "ok", Breakers: a.BreakerStates()}
+	if !a.ready.Load() {
+		resp.Status = "draining"
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+	for _, s := range resp.Breakers {
+		if s != BreakerClosed {
+			resp.Status = "degraded"
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// enqueue hands a stored CREATED message to the publisher, through the
+// fair queue when its class uses one. It never blocks: it reports false
+// when the queue is full or shutdown has closed it, and such messages stay
+// CREATED for the reconciler to pick up.
+func (a *API) enqueue(m Message) bool {
+	if q := a.fairQueueFor(m); q != nil {
+		return q.push(m, a.queueWeight(m.ClientID))
+	}
+	return a.toPublisher(m, false)
+}
+
+// toPublisher puts m on ReadyQ. Unless wait is set it gives up when
+// ReadyQ is full rather than wait for a stalled Kafka; with wait it gives
+// up when Shutdown starts. A message the publisher already holds is not
+// queued again.
+func (a *API) toPublisher(m Message, wait bool) bool {
+	a.qmu.RLock()
+	defer a.qmu.RUnlock()
+	if a.qclosed {
+		return false
+	}
+	if !a.pub.take(m.ID) {
+		return true
+	}
+	if wait {
+		select {
+		case a.ReadyQ <- m:
+			return true
+		case <-a.stopping:
+			a.pub.release(m.ID)
+			return false
+		}
+	}
+	select {
+	case a.ReadyQ <- m:
+		return true
+	default:
+		a.pub.release(m.ID)
+		return false
+	}
+}
+
+func (a *API) publishRoom() bool { return len(a.ReadyQ) < cap(a.ReadyQ) }
+
+// admit refuses with 503 the messages of p that could not be published
+// soon: their topic's breaker is open or their queue has no room for n
+// more. Held messages are published later and always admitted.
+func (a *API) admit(clientID string, p *prepared, n int) error {
+	if p.action == ActionHold {
+		return nil
+	}
+	topic := p.class.Topic
+	if b := a.KafkaBreakers[topic]; b.State() == BreakerOpen {
+		return unavailableError("kafka_unavailable", topic, b.RetryAfter())
+	}
+	if q := a.fair[topic]; q != nil && p.class.FairQueue {
+		if over := q.excess(clientID, n); over > 0 {
+			return unavailableError("queue_full", topic, min(60, int(math.Ceil(float64(over)/a.FairQueue.Rate))))
+		}
+		return nil
+	}
+	if len(a.ReadyQ)+n > cap(a.ReadyQ) {
+		return unavailableError("queue_full", topic, 1)
+	}
+	return nil
+}
+
+// StartPublisher runs PublishMessage until the queue is closed and drained.
+func (a *API) StartPublisher() {
+	a.bg.Add(1)
+	go func() {
+		defer a.bg.Done()
+		a.PublishMessage()
+	}()
+}
+
+// Shutdown drains the publish queue, waits for the background loops
+// (publisher, fair queue, status consumer, reconciler, archiver) to finish
+// and then closes the Kafka writers and the database. The HTTP server must already
+// be shut down and the context passed to the background loops canceled.
+// If ctx expires first the publisher's Kafka writes are canceled and the
+// remaining resources are closed anyway.
+func (a *API) Shutdown(ctx context.Context) error {
+	a.SetReady(false)
+
+	// unblock the fair queues' waiting sends, which hold qmu
+	a.stopOnce.Do(func() { close(a.stopping) })
+	a.qmu.Lock()
+	if !a.qclosed {
+		a.qclosed = true
+		close(a.ReadyQ)
+	}
+	a.qmu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.bg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("shutdown: background loops still running", "err", err)
+	}
+	// unwritten messages stay CREATED and are published after the restart
+	a.pubStop()
+
+	writers := map[string]TopicWriter{}
+	for t, w := range a.Writers {
+		writers[t] = w
+	}
+	if a.WStatusDLQ != nil {
+		writers[a.WStatusDLQ.Topic] = a.WStatusDLQ
+	}
+	for t, w := range writers {
+		if cerr := w.Close(); cerr != nil {
+			slog.Warn("shutdown: kafka writer close", "topic", t, "err", cerr)
+		}
+	}
+	if sqlDB, derr := a.DB.DB(); derr == nil {
+		if cerr := sqlDB.Close(); cerr != nil {
+			slog.Warn("shutdown: db close", "err", cerr)
+		}
+	}
+	return err
+}
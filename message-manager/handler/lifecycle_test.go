@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// stalledWriter is a Kafka that never answers.
+type stalledWriter struct{}
+
+func (stalledWriter) WriteMessages(ctx context.Context, _ ...kafka.Message) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (stalledWriter) Close() error { return nil }
+
+// TestShutdownStalledKafka checks that Shutdown returns once its context
+// expires while the publisher is stuck on Kafka and a send is waiting for
+// room in ReadyQ, and that the stuck write is then canceled.
+func TestShutdownStalledKafka(t *testing.T) {
+	w := stalledWriter{}
+	a := newFairTestAPI(t, map[string]TopicWriter{"sms.bulk.v1": w, "sms.otp.v1": w})
+	a.ReadyQ = make(chan Message, 1)
+	a.Publish = PublishConfig{BatchSize: 1}
+	a.StartPublisher()
+
+	a.toPublisher(Message{ID: 1, Type: "OTP"}, false)
+	time.Sleep(50 * time.Millisecond) // the publisher took it and is stuck writing
+	if !a.toPublisher(Message{ID: 2, Type: "OTP"}, false) {
+		t.Fatal("ReadyQ full too early")
+	}
+	go a.toPublisher(Message{ID: 3, Type: "BULK"}, true) // waits, as the fair queue does
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- a.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown hung")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		a.bg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher still writing after Shutdown")
+	}
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	messagesCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mm_messages_created_total",
+		Help: "Messages stored, by type and initial status (CREATED or HELD).",
+	}, []string{"type", "status"})
+
+	billingCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mm_billing_calls_total",
+		Help: "client-manager billing calls, by operation and gRPC code.",
+	}, []string{"op", "code"})
+
+	publishErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mm_kafka_publish_errors_total",
+		Help: "Failed Kafka writes of outgoing messages, by topic.",
+	}, []string{"topic"})
+
+	publishBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mm_kafka_publish_batch_size",
+		Help:    "Messages per WriteMessages call, by topic.",
+		Buckets: []float64{1, 5, 10, 50, 100, 250, 500, 1000},
+	}, []string{"topic"})
+
+	createLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mm_create_message_duration_seconds",
+		Help:    "POST /messages latency, by HTTP status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"code"})
+
+	statusLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mm_status_apply_duration_seconds",
+		Help:    "Time to apply one status event, by result (applied, rejected, error).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+
+	statusLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mm_status_consumer_lag",
+		Help: "Status events behind the partition's high watermark, as of the last fetch.",
+	}, []string{"partition"})
+
+	messagesArchived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mm_messages_archived_total",
+		Help: "Messages moved from the messages table into archives.",
+	})
+
+	breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mm_circuit_breaker_state",
+		Help: "Circuit breaker state, by breaker: 0 closed, 1 half-open, 2 open.",
+	}, []string{"breaker"})
+
+	fairQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mm_fair_queue_depth",
+		Help: "Messages waiting in the fair queue, by topic.",
+	}, []string{"topic"})
+)
+
+func init() {
+	prometheus.MustRegister(messagesCreated, billingCalls, publishErrors, publishBatchSize, createLatency, statusLatency, statusLag, messagesArchived, breakerState, fairQueueDepth)
+}
+
+// ServeMetrics exposes the default Prometheus registry.
+var ServeMetrics = gin.WrapH(promhttp.Handler())
+
+// observeBilling counts a client-manager call by its gRPC code ("OK" when
+// err is nil).
+func observeBilling(op string, err error) {
+	billingCalls.WithLabelValues(op, status.Code(err).String()).Inc()
+}
+
+func observeStatus(start time.Time, err error) {
+	result := "applied"
+	switch {
+	case err == nil:
+	case isRejected(err):
+		result = "rejected"
+	default:
+		result = "error"
+	}
+	statusLatency.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+func observeLag(partition int, highWaterMark, offset int64) {
+	lag := highWaterMark - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	statusLag.WithLabelValues(strconv.Itoa(partition)).Set(float64(lag))
+}
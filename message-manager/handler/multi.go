@@ -0,0 +1,230 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"message-manager/logging"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxRecipients caps the recipients of one request.
+const maxRecipients = 100
+
+// Recipients is the "to" of a CreateMessageRequest: one number, given as a
+// JSON string, or several, given as an array.
+type Recipients []string
+
+func (r *Recipients) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		var one string
+		if err := json.Unmarshal(b, &one); err != nil {
+			return err
+		}
+		*r = Recipients{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*r = many
+	return nil
+}
+
+func (r Recipients) MarshalJSON() ([]byte, error) {
+	if len(r) == 1 {
+		return json.Marshal(r[0])
+	}
+	return json.Marshal([]string(r))
+}
+
+// MessageRequest is the parent of the messages created by one request
+// with several recipients. Their money is reserved once, for the total;
+// each message then captures or releases its own share.
+type MessageRequest struct {
+	ID             int       `gorm:"primaryKey" json:"id"`
+	ClientID       string    `gorm:"size:64;index" json:"client_id"`
+	Recipients     int       `json:"recipients"`
+	PriceMinor     int64     `json:"price_minor"`
+	ReservationID  string    `gorm:"size:32" json:"-"`
+	ReservationRef string    `gorm:"size:32" json:"-"` // random, see Message.ReservationRef
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type RecipientResult struct {
+	ID     string `json:"id"`
+	To     string `json:"to"`
+	Status string `json:"status"`
+}
+
+type RequestSummary struct {
+	ID         int               `json:"id"`
+	Recipients int               `json:"recipients"`
+	PriceMinor int64             `json:"price_minor"`
+	Statuses   map[string]int    `json:"statuses"`
+	Items      []RecipientResult `json:"items"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// SendMulti is Send for a request with several recipients: one message per
+// recipient under a MessageRequest, all validated once, priced as a total
+// and backed by a single reservation.
+func (a *API) SendMulti(ctx context.Context, clientID string, req CreateMessageRequest) (MessageRequest, []Message, error) {
+	p, err := a.prepare(clientID, req)
+	if err != nil {
+		return MessageRequest{}, nil, err
+	}
+	if err := a.admit(clientID, p, len(p.req.To)); err != nil {
+		return MessageRequest{}, nil, err
+	}
+	now := time.Now()
+	parent := &MessageRequest{ClientID: clientID, Recipients: len(p.req.To), PriceMinor: p.price * int64(len(p.req.To)), CreatedAt: now}
+	msgs := make([]*Message, len(p.req.To))
+	for i, to := range p.req.To {
+		m := &Message{ClientID: clientID, From: p.req.From, To: to, Body: p.body, Type: p.req.Type, PriceMinor: p.price, Status: "CREATED", Campaign: p.req.Campaign, TraceParent: traceParent(ctx), RequestID: logging.Field(ctx, logging.RequestID), CreatedAt: now, UpdatedAt: now}
+		if p.action == ActionHold {
+			m.Status = "HELD"
+			m.HeldByRule = &p.rule.ID
+		}
+		msgs[i] = m
+	}
+
+	// one hold for the total, taken before the insert as in Send
+	parent.ReservationRef = newReservationRef()
+	resID, err := a.reserve(ctx, clientID, parent.PriceMinor, parent.ReservationRef)
+	if err != nil {
+		if errors.Is(err, errInsufficientFunds) {
+			return MessageRequest{}, nil, refuse(http.StatusPaymentRequired, "insufficient_funds", "")
+		}
+		return MessageRequest{}, nil, err
+	}
+	parent.ReservationID = resID
+	for _, m := range msgs {
+		m.ReservationID = resID
+		m.ReservationRef = parent.ReservationRef
+	}
+
+	if err := a.Messages.Tx(ctx, func(tx *MessageTx) error {
+		if err := tx.db.Create(parent).Error; err != nil {
+			return err
+		}
+		for i, m := range msgs {
+			m.ParentID = &parent.ID
+			links := p.links
+			if i > 0 && p.req.ShortenURLs {
+				// every recipient gets its own codes, so clicks are per message
+				var err error
+				if m.Body, links, err = a.shortenBody(p.req.Body, clientID, p.req.Campaign); err != nil {
+					return err
+				}
+			}
+			if err := tx.Create(m); err != nil {
+				return err
+			}
+			if err := rollStats(tx.db, m, "", ""); err != nil {
+				return err
+			}
+			if err := indexMessage(tx.db, m); err != nil {
+				return err
+			}
+			for j := range links {
+				links[j].MessageID = m.ID
+			}
+			if len(links) > 0 {
+				if err := tx.db.Create(&links).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		if resID != "" {
+			_ = a.release(ctx, clientID, resID, 0, parent.ReservationRef)
+		}
+		return MessageRequest{}, nil, err
+	}
+
+	out := make([]Message, len(msgs))
+	for i, m := range msgs {
+		messagesCreated.WithLabelValues(m.Type, m.Status).Inc()
+		a.notify(*m)
+		if m.Status == "CREATED" && !a.enqueue(*m) {
+			slog.WarnContext(ctx, "publish queue full; left for the reconciler", logging.MessageID, msgRef(m.ID))
+		}
+		out[i] = *m
+	}
+	slog.InfoContext(ctx, "message request stored", "parent_id", parent.ID, "recipients", parent.Recipients, "price_minor", parent.PriceMinor)
+	return *parent, out, nil
+}
+
+// RequestSummary counts the statuses of a request's messages.
+func (a *API) RequestSummary(clientID, id string) (RequestSummary, error) {
+	var parent MessageRequest
+	if err := a.DB.First(&parent, "id = ? AND client_id = ?", id, clientID).Error; err != nil {
+		return RequestSummary{}, err
+	}
+	msgs, err := a.Messages.Find(context.Background(), MessageQuery{ParentID: parent.ID, Order: ByID})
+	if err != nil {
+		return RequestSummary{}, err
+	}
+	s := RequestSummary{
+		ID: parent.ID, Recipients: parent.Recipients, PriceMinor: parent.PriceMinor, CreatedAt: parent.CreatedAt,
+		Statuses: map[string]int{}, Items: make([]RecipientResult, 0, len(msgs)),
+	}
+	for _, m := range msgs {
+		s.Statuses[m.Status]++
+		s.Items = append(s.Items, RecipientResult{ID: strconv.Itoa(m.ID), To: m.To, Status: m.Status})
+	}
+	if archived := parent.Recipients - len(msgs); archived > 0 {
+		s.Statuses["ARCHIVED"] = archived
+	}
+	return s, nil
+}
+
+func (a *API) GetRequest(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	s, err := a.RequestSummary(clientID, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// validRecipients checks the recipients of a request; duplicates would be
+// charged twice, so they are refused.
+func validRecipients(to Recipients) error {
+	if len(to) > maxRecipients {
+		return refuse(http.StatusBadRequest, "too_many_recipients", fmt.Sprintf("at most %d", maxRecipients))
+	}
+	seen := map[string]bool{}
+	for _, r := range to {
+		if r == "" {
+			return refuse(http.StatusBadRequest, "to and body are required", "")
+		}
+		n := normalizeRecipient(r)
+		if seen[n] {
+			return refuse(http.StatusBadRequest, "duplicate_recipient", r)
+		}
+		seen[n] = true
+	}
+	return nil
+}
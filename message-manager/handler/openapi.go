@@ -0,0 +1,299 @@
+package handler
+
+import (
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/gin-gonic/gin"
+)
+
+// openapiJSON is the public REST API. Keep it in sync with the handlers;
+// CheckContract reports where the two disagree.
+//
+//go:embed openapi.json
+var openapiJSON []byte
+
+var (
+	specOnce   sync.Once
+	specDoc    *openapi3.T
+	specRouter routers.Router
+	specErr    error
+)
+
+// Spec returns the parsed and validated OpenAPI document.
+func Spec() (*openapi3.T, routers.Router, error) {
+	specOnce.Do(func() {
+		doc, err := openapi3.NewLoader().LoadFromData(openapiJSON)
+		if err == nil {
+			err = doc.Validate(context.Background())
+		}
+		if err != nil {
+			specErr = fmt.Errorf("openapi.json: %w", err)
+			return
+		}
+		specDoc = doc
+		specRouter, specErr = legacy.NewRouter(doc)
+	})
+	return specDoc, specRouter, specErr
+}
+
+func ServeSpec(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openapiJSON)
+}
+
+// validateRequest checks requests for documented operations against the
+// spec and answers 400 invalid_request when they do not conform. Routes
+// the spec does not describe (admin, probes) pass through untouched.
+func (a *API) validateRequest(c *gin.Context) {
+	_, router, err := Spec()
+	if err != nil {
+		c.Next()
+		return
+	}
+	route, params, err := router.FindRoute(c.Request)
+	if err != nil {
+		c.Next()
+		return
+	}
+	in := &openapi3filter.RequestValidationInput{
+		Request:    c.Request,
+		PathParams: params,
+		Route:      route,
+		Options:    &openapi3filter.Options{MultiError: false},
+	}
+	if err := openapi3filter.ValidateRequest(c.Request.Context(), in); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_request", Detail: validationDetail(err)})
+		return
+	}
+	c.Next()
+}
+
+// validationDetail names the offending parameter or body field without
+// echoing the schema back to the caller.
+func validationDetail(err error) string {
+	var re *openapi3filter.RequestError
+	if !errors.As(err, &re) {
+		return err.Error()
+	}
+	var se *openapi3.SchemaError
+	reason := re.Reason
+	if errors.As(re.Err, &se) {
+		reason = se.Reason
+		if p := se.JSONPointer(); len(p) > 0 {
+			reason = strings.Join(p, ".") + ": " + reason
+		}
+	} else if reason == "" && re.Err != nil {
+		reason = re.Err.Error()
+	}
+	if re.Parameter != nil {
+		return fmt.Sprintf("%s %s: %s", re.Parameter.In, re.Parameter.Name, reason)
+	}
+	return "body: " + reason
+}
+
+// contractTypes maps spec schemas to the Go types the handlers read or
+// write for them.
+var contractTypes = map[string]any{
+	"ErrorResponse":          ErrorResponse{},
+	"CreateMessageRequest":   CreateMessageRequest{},
+	"CreateMessageResponse":  CreateMessageResponse{},
+	"Message":                Message{},
+	"MessageList":            MessageList{},
+	"LinkClicks":             LinkClicks{},
+	"MessageClickStats":      MessageClickStats{},
+	"CampaignClickStats":     CampaignClickStats{},
+	"RegisterSenderRequest":  RegisterSenderRequest{},
+	"Sender":                 Sender{},
+	"SenderList":             SenderList{},
+	"ClientSetting":          ClientSetting{},
+	"UpdateSettingsRequest":  UpdateSettingsRequest{},
+	"MessageArchive":         MessageArchive{},
+	"ArchiveList":            ArchiveList{},
+	"RestoreArchiveResponse": RestoreArchiveResponse{},
+	"StatsPoint":             StatsPoint{},
+	"StatsTotals":            StatsTotals{},
+	"StatsResponse":          StatsResponse{},
+	"QuoteBatchRequest":      QuoteBatchRequest{},
+	"QuoteItem":              QuoteItem{},
+	"QuoteResponse":          QuoteResponse{},
+	"RecipientResult":        RecipientResult{},
+	"RequestSummary":         RequestSummary{},
+}
+
+// contractRequests are requests clients send that the spec must accept.
+var contractRequests = []struct{ method, target string }{
+	{http.MethodGet, "/messages?status=DELIVERED&type=OTP"},
+	{http.MethodGet, "/messages?status=delivered&type=otp"},
+	{http.MethodGet, "/messages/search?q=hello&status=delivered"},
+}
+
+// undocumentedRoutes are served but deliberately left out of the spec.
+var undocumentedRoutes = []string{"/readyz", "/openapi.json", "/metrics", "/admin/"}
+
+var pathParamRe = regexp.MustCompile(`\{([^}]+)\}`)
+
+// CheckContract compares the spec with the routes registered on r and the
+// Go types in contractTypes, and returns every mismatch it finds.
+func CheckContract(r *gin.Engine) error {
+	doc, _, err := Spec()
+	if err != nil {
+		return err
+	}
+	var problems []string
+
+	served := map[string]bool{}
+	for _, ri := range r.Routes() {
+		served[ri.Method+" "+ri.Path] = true
+	}
+	documented := map[string]bool{}
+	for path, item := range doc.Paths.Map() {
+		ginPath := pathParamRe.ReplaceAllString(path, ":$1")
+		for method := range item.Operations() {
+			key := method + " " + ginPath
+			documented[key] = true
+			if !served[key] {
+				problems = append(problems, "documented but not served: "+key)
+			}
+		}
+	}
+	for key := range served {
+		if documented[key] || undocumented(key) {
+			continue
+		}
+		problems = append(problems, "served but not documented: "+key)
+	}
+
+	for _, cr := range contractRequests {
+		if err := validateExample(cr.method, cr.target); err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s: rejected: %s", cr.method, cr.target, validationDetail(err)))
+		}
+	}
+
+	for name, v := range contractTypes {
+		ref := doc.Components.Schemas[name]
+		if ref == nil || ref.Value == nil {
+			problems = append(problems, "schema missing: "+name)
+			continue
+		}
+		problems = append(problems, compareSchema(name, ref.Value, reflect.TypeOf(v))...)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New("openapi contract:\n  " + strings.Join(problems, "\n  "))
+}
+
+// validateExample validates a request a client with ID "demo" would send.
+func validateExample(method, target string) error {
+	_, router, err := Spec()
+	if err != nil {
+		return err
+	}
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("X-Client-ID", "demo")
+	route, params, err := router.FindRoute(req)
+	if err != nil {
+		return err
+	}
+	return openapi3filter.ValidateRequest(context.Background(), &openapi3filter.RequestValidationInput{
+		Request: req, PathParams: params, Route: route,
+	})
+}
+
+func undocumented(key string) bool {
+	path := key[strings.IndexByte(key, ' ')+1:]
+	for _, p := range undocumentedRoutes {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// compareSchema checks that an object schema and a struct have the same
+// JSON properties with compatible types, and that fields gin binds as
+// required are required in the spec.
+func compareSchema(name string, s *openapi3.Schema, t reflect.Type) []string {
+	var problems []string
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		fields[tag] = f
+	}
+	required := map[string]bool{}
+	for _, p := range s.Required {
+		required[p] = true
+	}
+
+	for prop, ps := range s.Properties {
+		f, ok := fields[prop]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: in spec, not in %s", name, prop, t.Name()))
+			continue
+		}
+		// properties without a single type (oneOf) are not compared
+		if want := jsonType(f.Type); ps.Value != nil && want != "" && len(ps.Value.Type.Slice()) > 0 && !ps.Value.Type.Is(want) {
+			problems = append(problems, fmt.Sprintf("%s.%s: spec type %v, Go type %s", name, prop, ps.Value.Type.Slice(), f.Type))
+		}
+	}
+	for prop, f := range fields {
+		if _, ok := s.Properties[prop]; !ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: in %s, not in spec", name, prop, t.Name()))
+			continue
+		}
+		if strings.Contains(f.Tag.Get("binding"), "required") && !required[prop] {
+			problems = append(problems, fmt.Sprintf("%s.%s: required by the handler, optional in spec", name, prop))
+		}
+	}
+	return problems
+}
+
+func jsonType(t reflect.Type) string {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return openapi3.TypeString
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return openapi3.TypeString
+	case reflect.Bool:
+		return openapi3.TypeBoolean
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return openapi3.TypeInteger
+	case reflect.Float32, reflect.Float64:
+		return openapi3.TypeNumber
+	case reflect.Slice, reflect.Array:
+		return openapi3.TypeArray
+	case reflect.Struct, reflect.Map:
+		return openapi3.TypeObject
+	}
+	return ""
+}
@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestContract fails when openapi.json and the registered routes or the
+// request/response structs disagree.
+func TestContract(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	(&API{}).RegisterRoutes(r)
+	if err := CheckContract(r); err != nil {
+		t.Fatal(err)
+	}
+}
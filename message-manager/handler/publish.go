@@ -0,0 +1,317 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"message-manager/logging"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PublishConfig controls how the publisher batches: it writes once BatchSize
+// messages are waiting or Linger after the first of them, whichever comes
+// first, with one WriteMessages call per topic.
+type PublishConfig struct {
+	BatchSize int
+	Linger    time.Duration
+}
+
+const (
+	defaultPublishBatch  = 500
+	defaultPublishLinger = 5 * time.Millisecond
+)
+
+// TopicWriter is what the publisher needs of a *kafka.Writer for one
+// topic.
+type TopicWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// PublishMessage writes queued messages to Kafka in batches until ReadyQ
+// is closed, then flushes what it holds.
+func (a *API) PublishMessage() {
+	a.publishFrom(a.ReadyQ)
+}
+
+// PublishAll runs the publisher over msgs, which must be stored CREATED,
+// and returns once all are written or have failed, with how many it
+// marked QUEUED. It is for benchmarks and load tools; the server publishes
+// through ReadyQ.
+func (a *API) PublishAll(msgs []Message) int {
+	q := make(chan Message, len(msgs))
+	for _, m := range msgs {
+		q <- m
+	}
+	close(q)
+	return a.publishFrom(q)
+}
+
+// publishFrom publishes what comes from q until it is closed and returns
+// how many messages it marked QUEUED.
+func (a *API) publishFrom(q <-chan Message) int {
+	size, linger := a.Publish.BatchSize, a.Publish.Linger
+	if size <= 0 {
+		size = defaultPublishBatch
+	}
+	if linger <= 0 {
+		linger = defaultPublishLinger
+	}
+	queued := 0
+	batch := make([]Message, 0, size)
+	for m := range q {
+		batch = append(batch[:0], m)
+		closed := false
+		timer := time.NewTimer(linger)
+	fill:
+		for len(batch) < size {
+			select {
+			case m, ok := <-q:
+				if !ok {
+					closed = true
+					break fill
+				}
+				batch = append(batch, m)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+		queued += a.publishBatch(batch)
+		if closed {
+			break
+		}
+	}
+	return queued
+}
+
+// publishing tracks the messages the publisher holds: those on ReadyQ or
+// in a batch being written, and those Kafka took but that could not be
+// marked QUEUED yet. The reconciler leaves them alone, so none is written
+// twice.
+type publishing struct {
+	mu       sync.Mutex
+	held     map[int]bool
+	unmarked map[int]Message
+}
+
+// take claims id for the publisher; false means it already holds it.
+func (p *publishing) take(id int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held[id] {
+		return false
+	}
+	if _, ok := p.unmarked[id]; ok {
+		return false
+	}
+	if p.held == nil {
+		p.held = map[int]bool{}
+	}
+	p.held[id] = true
+	return true
+}
+
+func (p *publishing) release(ids ...int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		delete(p.held, id)
+		delete(p.unmarked, id)
+	}
+}
+
+// written records msgs as in Kafka but still CREATED in the database.
+func (p *publishing) written(msgs []Message) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.unmarked == nil {
+		p.unmarked = map[int]Message{}
+	}
+	for _, m := range msgs {
+		delete(p.held, m.ID)
+		p.unmarked[m.ID] = m
+	}
+}
+
+func (p *publishing) holds(id int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.unmarked[id]
+	return ok || p.held[id]
+}
+
+func (p *publishing) pendingMarks() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	msgs := make([]Message, 0, len(p.unmarked))
+	for _, m := range p.unmarked {
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// outgoing is a message on its way to Kafka.
+type outgoing struct {
+	m    Message
+	ctx  context.Context
+	span trace.Span
+}
+
+// publishBatch writes msgs with one call per topic and marks the written
+// ones QUEUED, returning how many it marked. Messages that are not written
+// stay CREATED; the reconciler republishes them.
+func (a *API) publishBatch(msgs []Message) int {
+	byTopic := map[string][]outgoing{}
+	var topics []string
+	for _, m := range msgs {
+		ctx := logging.With(context.Background(), logging.MessageID, strconv.Itoa(m.ID))
+		ctx = logging.With(ctx, logging.ClientID, m.ClientID)
+		ctx = logging.With(ctx, logging.RequestID, m.RequestID)
+		topic := a.topicFor(m.Type)
+		if topic == "" {
+			// its class was removed from the routing config; it stays
+			// CREATED until the class is back or the reconciler expires it
+			slog.ErrorContext(ctx, "publish failed: no routing class", "type", m.Type)
+			publishErrors.WithLabelValues("").Inc()
+			continue
+		}
+		if byTopic[topic] == nil {
+			topics = append(topics, topic)
+		}
+		byTopic[topic] = append(byTopic[topic], outgoing{m: m, ctx: ctx})
+	}
+
+	var written []Message
+	for _, topic := range topics {
+		written = append(written, a.writeTopic(topic, a.Writers[topic], byTopic[topic])...)
+	}
+	// the ones not written go back to the reconciler
+	a.pub.written(written)
+	ok := make(map[int]bool, len(written))
+	for _, m := range written {
+		ok[m.ID] = true
+	}
+	var failed []int
+	for _, m := range msgs {
+		if !ok[m.ID] {
+			failed = append(failed, m.ID)
+		}
+	}
+	a.pub.release(failed...)
+	if len(written) == 0 {
+		return 0
+	}
+	return a.markWritten(written)
+}
+
+// markWritten marks messages Kafka took QUEUED and returns how many it
+// marked. On failure they stay with the publisher and the reconciler
+// retries the update rather than publish them again.
+func (a *API) markWritten(written []Message) int {
+	queued, err := a.markQueued(written)
+	if err != nil {
+		slog.Error("mark queued failed", "messages", len(written), "err", err)
+		return 0
+	}
+	ids := make([]int, len(written))
+	for i, m := range written {
+		ids[i] = m.ID
+	}
+	a.pub.release(ids...)
+	for _, m := range queued {
+		a.notify(m)
+	}
+	return len(queued)
+}
+
+// writeTopic writes out to w in one call and returns the messages Kafka
+// accepted.
+func (a *API) writeTopic(topic string, w TopicWriter, out []outgoing) []Message {
+	br := a.KafkaBreakers[topic]
+	if !br.Allow() {
+		slog.Warn("publish skipped: circuit open", "topic", topic, "messages", len(out))
+		publishErrors.WithLabelValues(topic).Add(float64(len(out)))
+		return nil
+	}
+	kmsgs := make([]kafka.Message, len(out))
+	for i := range out {
+		o := &out[i]
+		m := o.m
+		val := map[string]any{"message_id": strconv.Itoa(m.ID), "client_id": m.ClientID, "from": m.From, "to": m.To, "body": m.Body, "type": m.Type, "price": m.PriceMinor}
+		b, _ := json.Marshal(val)
+		kmsg := kafka.Message{Key: []byte(strconv.Itoa(m.ID)), Value: b, Headers: []kafka.Header{{Key: "x-msg-id", Value: []byte(strconv.Itoa(m.ID))}, {Key: "x-client-id", Value: []byte(m.ClientID)}, {Key: "x-type", Value: []byte(m.Type)}}}
+		if m.RequestID != "" {
+			kmsg.Headers = append(kmsg.Headers, kafka.Header{Key: "x-request-id", Value: []byte(m.RequestID)})
+		}
+		o.ctx, o.span = tracer.Start(withTraceParent(o.ctx, m.TraceParent), "publish "+topic,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.Int("message.id", m.ID), attribute.String("client.id", m.ClientID), attribute.Int("batch.size", len(out))))
+		otel.GetTextMapPropagator().Inject(o.ctx, kafkaHeaders{&kmsg.Headers})
+		kmsgs[i] = kmsg
+	}
+
+	err := w.WriteMessages(a.pubCtx, kmsgs...)
+	// with WriteErrors only the messages at non-nil indexes failed
+	var perMsg kafka.WriteErrors
+	partial := errors.As(err, &perMsg) && len(perMsg) == len(out)
+	var written []Message
+	for i, o := range out {
+		merr := err
+		if partial {
+			merr = perMsg[i]
+		}
+		if merr != nil {
+			o.span.RecordError(merr)
+			o.span.SetStatus(otelcodes.Error, "kafka write failed")
+			slog.ErrorContext(o.ctx, "publish failed", "topic", topic, "err", merr)
+			publishErrors.WithLabelValues(topic).Inc()
+		} else {
+			written = append(written, o.m)
+		}
+		o.span.End()
+	}
+	br.Done(len(written) > 0 || len(out) == 0)
+	publishBatchSize.WithLabelValues(topic).Observe(float64(len(out)))
+	return written
+}
+
+// markQueued moves msgs from CREATED to QUEUED with one UPDATE and returns
+// the ones it moved; a status event may already have moved others on.
+func (a *API) markQueued(msgs []Message) ([]Message, error) {
+	byID := make(map[int]Message, len(msgs))
+	ids := make([]int, 0, len(msgs))
+	for _, m := range msgs {
+		byID[m.ID] = m
+		ids = append(ids, m.ID)
+	}
+	now := time.Now()
+	var queued []Message
+	err := a.Messages.Tx(context.Background(), func(tx *MessageTx) error {
+		still, err := tx.Move(ids, "CREATED", "QUEUED", now)
+		if err != nil || len(still) == 0 {
+			return err
+		}
+		queued = make([]Message, 0, len(still))
+		for _, id := range still {
+			m := byID[id]
+			m.Status, m.UpdatedAt = "QUEUED", now
+			queued = append(queued, m)
+		}
+		return rollStatsBatch(tx.db, queued, "CREATED")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return queued, nil
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	initx "message-manager/init"
+
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm/logger"
+)
+
+// fakeWriter takes every write after latency, as a broker round trip
+// would.
+type fakeWriter struct {
+	latency time.Duration
+	written atomic.Int64
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	time.Sleep(w.latency)
+	w.written.Add(int64(len(msgs)))
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+// BenchmarkPublisher publishes b.N stored messages through a writer with
+// 1ms per call and an SQLite database, and reports msg/s.
+func BenchmarkPublisher(b *testing.B) {
+	for _, size := range []int{1, 100, 500} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			db, err := initx.OpenDB("sqlite://" + b.TempDir() + "/mm.db")
+			if err != nil {
+				b.Fatal(err)
+			}
+			db.Logger = logger.Default.LogMode(logger.Silent)
+			routing, err := NewRouting("BENCH", []RoutingClass{{Name: "BENCH", Topic: "sms.bench.v1", PriceColumn: PriceColumnNormal}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			w := &fakeWriter{latency: time.Millisecond}
+			a := NewAPI(db, routing, map[string]TopicWriter{"sms.bench.v1": w}, nil, nil, 1, 1)
+			a.Publish = PublishConfig{BatchSize: size, Linger: 5 * time.Millisecond}
+			if err := a.AutoMigrate(); err != nil {
+				b.Fatal(err)
+			}
+			msgs := make([]Message, b.N)
+			now := time.Now()
+			for i := range msgs {
+				msgs[i] = Message{ClientID: "bench", To: fmt.Sprintf("+98912%07d", i), Body: "publishbench", Type: "BENCH", PriceMinor: 1, Status: "CREATED", CreatedAt: now, UpdatedAt: now}
+			}
+			if err := db.CreateInBatches(&msgs, 1000).Error; err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			queued := a.PublishAll(msgs)
+			b.StopTimer()
+			if queued != b.N || w.written.Load() != int64(b.N) {
+				b.Fatalf("queued %d and wrote %d of %d messages", queued, w.written.Load(), b.N)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msg/s")
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	clientpb "message-manager/gen"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/status"
+)
+
+// maxQuoteBatch caps POST /messages/quote, like SendBatch over gRPC.
+const maxQuoteBatch = 500
+
+type QuoteBatchRequest struct {
+	Messages []CreateMessageRequest `json:"messages" binding:"required"`
+}
+
+// QuoteItem is the price of one message, or why it would be refused.
+type QuoteItem struct {
+	Index          int    `json:"index"`
+	Type           string `json:"type,omitempty"`
+	Recipients     int    `json:"recipients,omitempty"`
+	Segments       int    `json:"segments,omitempty"`
+	UnitPriceMinor int64  `json:"unit_price_minor,omitempty"`
+	PriceMinor     int64  `json:"price_minor,omitempty"`
+	Held           bool   `json:"held,omitempty"` // a HOLD rule matched; it would wait for review
+	Error          string `json:"error,omitempty"`
+	Detail         string `json:"detail,omitempty"`
+
+	refusal *SendError
+}
+
+type QuoteResponse struct {
+	Items           []QuoteItem `json:"items"`
+	TotalPriceMinor int64       `json:"total_price_minor"`
+	BalanceMinor    int64       `json:"balance_minor"`
+	Sufficient      bool        `json:"sufficient"` // the balance covers the total
+}
+
+// segments is how many SMS parts body is sent as; only routing classes
+// with a max_length over 160 let multi-part bodies through.
+func segments(body string) int {
+	return (runeCount(body) + 159) / 160
+}
+
+// Quote prices reqs the way Send would, running every check, without
+// reserving, storing or publishing anything. Refused messages are reported
+// per item and left out of the total.
+func (a *API) Quote(ctx context.Context, clientID string, reqs []CreateMessageRequest) (QuoteResponse, error) {
+	resp := QuoteResponse{Items: make([]QuoteItem, 0, len(reqs))}
+	for i, req := range reqs {
+		item := QuoteItem{Index: i}
+		p, err := a.prepare(clientID, req)
+		var se *SendError
+		switch {
+		case err == nil:
+			item.Type = p.req.Type
+			item.Recipients = len(p.req.To)
+			item.Segments = segments(p.body)
+			item.UnitPriceMinor = p.price / int64(item.Segments)
+			item.PriceMinor = p.price * int64(item.Recipients)
+			item.Held = p.action == ActionHold
+			resp.TotalPriceMinor += item.PriceMinor
+		case errors.As(err, &se):
+			item.Error, item.Detail, item.refusal = se.Code, se.Detail, se
+		default:
+			return resp, err
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	bal, err := a.balance(ctx, clientID)
+	if err != nil {
+		return resp, err
+	}
+	resp.BalanceMinor = bal
+	resp.Sufficient = bal >= resp.TotalPriceMinor
+	return resp, nil
+}
+
+// balance is the client's available balance in client-manager; money held
+// by open reservations is not part of it.
+func (a *API) balance(ctx context.Context, clientID string) (int64, error) {
+	if a.CM == nil {
+		return 0, fmt.Errorf("client-manager grpc client not set")
+	}
+	resp, err := a.CM.GetClient(ctx, &clientpb.GetClientRequest{ClientId: clientID})
+	if err != nil {
+		if unavailable(err) {
+			return 0, unavailableError("billing_unavailable", status.Convert(err).Message(), a.CMBreaker.RetryAfter())
+		}
+		return 0, err
+	}
+	return resp.GetClient().GetBalanceMinor(), nil
+}
+
+// QuoteMessages serves POST /messages/quote. The body is either one
+// CreateMessageRequest, whose refusal is answered like POST /messages
+// would, or {"messages": [...]}, which reports refusals per item.
+func (a *API) QuoteMessages(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	var probe struct {
+		Messages json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if probe.Messages != nil {
+		var req QuoteBatchRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if len(req.Messages) == 0 || len(req.Messages) > maxQuoteBatch {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_batch", Detail: fmt.Sprintf("1 to %d messages per quote", maxQuoteBatch)})
+			return
+		}
+		resp, err := a.Quote(c.Request.Context(), clientID, req.Messages)
+		if err != nil {
+			writeError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	var req CreateMessageRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	resp, err := a.Quote(c.Request.Context(), clientID, []CreateMessageRequest{req})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if r := resp.Items[0].refusal; r != nil {
+		writeError(c, r)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,138 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"message-manager/logging"
+
+	"gorm.io/gorm"
+)
+
+// MessageEvent is an audit record of something done to a message outside
+// the normal create/publish/status flow.
+type MessageEvent struct {
+	ID         int       `gorm:"primaryKey" json:"id"`
+	MessageID  int       `gorm:"index" json:"message_id"`
+	Kind       string    `gorm:"size:32" json:"kind"`
+	FromStatus string    `gorm:"size:16" json:"from_status"`
+	ToStatus   string    `gorm:"size:16" json:"to_status"`
+	Detail     string    `gorm:"size:512" json:"detail,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ReconcileConfig holds how long a message may sit in each non-final
+// status before the reconciler acts on it. Zero disables that check.
+type ReconcileConfig struct {
+	Interval    time.Duration
+	CreatedSLA  time.Duration
+	QueuedSLA   time.Duration
+	AcceptedSLA time.Duration
+	BatchSize   int
+}
+
+func (a *API) recordEvent(tx *gorm.DB, msgID int, kind, from, to, detail string) error {
+	return tx.Create(&MessageEvent{MessageID: msgID, Kind: kind, FromStatus: from, ToStatus: to, Detail: detail, CreatedAt: time.Now()}).Error
+}
+
+// StartReconciler periodically republishes messages stuck in CREATED and
+// expires (releasing the reservation) messages stuck in QUEUED or ACCEPTED.
+func (a *API) StartReconciler(ctx context.Context) {
+	if a.Reconcile.Interval <= 0 {
+		return
+	}
+	a.bg.Add(1)
+	go func() {
+		defer a.bg.Done()
+		t := time.NewTicker(a.Reconcile.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				a.reconcileOnce(ctx)
+			}
+		}
+	}()
+}
+
+func (a *API) reconcileOnce(ctx context.Context) {
+	if msgs := a.pub.pendingMarks(); len(msgs) > 0 {
+		a.markWritten(msgs)
+	}
+	if sla := a.Reconcile.CreatedSLA; sla > 0 {
+		for _, m := range a.stale("CREATED", sla) {
+			a.republish(m)
+		}
+	}
+	for status, sla := range map[string]time.Duration{"QUEUED": a.Reconcile.QueuedSLA, "ACCEPTED": a.Reconcile.AcceptedSLA} {
+		if sla <= 0 {
+			continue
+		}
+		for _, m := range a.stale(status, sla) {
+			if err := a.expire(ctx, m.ID, status, sla); err != nil {
+				slog.Warn("reconcile expire failed", logging.MessageID, msgRef(m.ID), "err", err)
+			}
+		}
+	}
+}
+
+func (a *API) stale(status string, sla time.Duration) []Message {
+	n := a.Reconcile.BatchSize
+	if n <= 0 {
+		n = 500
+	}
+	msgs, err := a.Messages.Find(context.Background(), MessageQuery{Status: status, UpdatedBefore: time.Now().Add(-sla), Order: StalestFirst, Limit: n})
+	if err != nil {
+		slog.Error("reconcile scan failed", "status", status, "err", err)
+	}
+	return msgs
+}
+
+func (a *API) republish(m Message) {
+	// touch updated_at so the same row is not picked up again next tick
+	if ok, err := a.Messages.Touch(context.Background(), m.ID, "CREATED"); err != nil || !ok {
+		return
+	}
+	if a.fairQueued(m.ID) || a.pub.holds(m.ID) {
+		// still waiting its turn, or written and waiting to be marked
+		// QUEUED; touched so the scan moves past it
+		return
+	}
+	if err := a.recordEvent(a.DB, m.ID, "RECONCILE_REPUBLISH", "CREATED", "CREATED", ""); err != nil {
+		slog.Warn("reconcile event failed", logging.MessageID, msgRef(m.ID), "err", err)
+	}
+	a.enqueue(m)
+}
+
+func (a *API) expire(ctx context.Context, id int, from string, sla time.Duration) error {
+	expired := false
+	msg, err := a.Messages.Transition(ctx, id, func(tx *MessageTx, msg *Message) error {
+		if msg.Status != from || !canTransition(from, "EXPIRED") {
+			return nil // moved on since the scan
+		}
+		now := time.Now()
+		msg.Status = "EXPIRED"
+		msg.StatusAt = &now
+		msg.UpdatedAt = now
+		if err := tx.Save(msg); err != nil {
+			return err
+		}
+		if err := rollStats(tx.db, msg, from, msg.Operator); err != nil {
+			return err
+		}
+		if err := a.recordEvent(tx.db, msg.ID, "RECONCILE_EXPIRE", from, "EXPIRED", fmt.Sprintf("no status change for %s", sla)); err != nil {
+			return err
+		}
+		expired = true
+		// release last: a failure rolls the expiry back and the next tick retries
+		return a.settleOnce(ctx, tx, msg)
+	})
+	if err == nil && expired {
+		a.notify(msg)
+	}
+	return err
+}
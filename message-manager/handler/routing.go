@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Price columns a routing class can be charged at; they mirror the two
+// columns of client-manager's PricePlan.
+const (
+	PriceColumnNormal   = "normal"
+	PriceColumnPriority = "priority"
+)
+
+const (
+	defaultMaxLength = 160
+	maxClassLength   = 16 // MessageStat.Type
+)
+
+// RoutingClass is a message type a client can send: which topic it is
+// published to, which price it is charged at and which checks it goes
+// through on top of the ones every message gets.
+type RoutingClass struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic"`
+	PriceColumn string `json:"price_column"` // normal|priority
+	// MaxLength caps the body, in characters after URL shortening;
+	// 0 means one SMS part. Longer bodies are charged per part.
+	MaxLength     int  `json:"max_length"`
+	RequireSender bool `json:"require_sender"` // refuse messages without an approved sender
+	NoURLs        bool `json:"no_urls"`        // refuse bodies with http(s) URLs
+	// MaskBody marks bodies a client can hide from API responses with
+	// the mask_priority_bodies setting, e.g. OTP codes.
+	MaskBody bool `json:"mask_body"`
+	// Clients limits the class to these client IDs; empty allows all.
+	Clients []string `json:"clients"`
+	// FairQueue releases the class's messages to its topic through the
+	// per-client fair queue (see FairQueueConfig). Classes sharing a topic
+	// must agree on it.
+	FairQueue bool `json:"fair_queue"`
+}
+
+func (c *RoutingClass) maxLength() int {
+	if c.MaxLength <= 0 {
+		return defaultMaxLength
+	}
+	return c.MaxLength
+}
+
+func (c *RoutingClass) allows(clientID string) bool {
+	if len(c.Clients) == 0 {
+		return true
+	}
+	for _, id := range c.Clients {
+		if id == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Routing is the set of routing classes. Class names are upper case and
+// matched case-insensitively.
+type Routing struct {
+	Default string
+	classes map[string]*RoutingClass
+}
+
+type routingFile struct {
+	Default string         `json:"default"`
+	Classes []RoutingClass `json:"classes"`
+}
+
+// ParseRouting reads a routing config:
+//
+//	{"default": "NORMAL", "classes": [{"name": "NORMAL", "topic": "sms.normal.v1", "price_column": "normal"}, ...]}
+func ParseRouting(data []byte) (*Routing, error) {
+	var f routingFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return NewRouting(f.Default, f.Classes)
+}
+
+// NewRouting checks classes and indexes them by name. def is the class of
+// messages that do not name one.
+func NewRouting(def string, classes []RoutingClass) (*Routing, error) {
+	r := &Routing{Default: strings.ToUpper(strings.TrimSpace(def)), classes: map[string]*RoutingClass{}}
+	fair := map[string]bool{}
+	for i := range classes {
+		c := classes[i]
+		c.Name = strings.ToUpper(strings.TrimSpace(c.Name))
+		switch {
+		case c.Name == "" || len(c.Name) > maxClassLength:
+			return nil, fmt.Errorf("routing class %d: name must be 1 to %d characters", i, maxClassLength)
+		case r.classes[c.Name] != nil:
+			return nil, fmt.Errorf("routing class %s: defined twice", c.Name)
+		case c.Topic == "":
+			return nil, fmt.Errorf("routing class %s: no topic", c.Name)
+		case c.PriceColumn != PriceColumnNormal && c.PriceColumn != PriceColumnPriority:
+			return nil, fmt.Errorf("routing class %s: price_column must be %s or %s", c.Name, PriceColumnNormal, PriceColumnPriority)
+		}
+		if f, ok := fair[c.Topic]; ok && f != c.FairQueue {
+			return nil, fmt.Errorf("routing class %s: fair_queue differs from other classes on %s", c.Name, c.Topic)
+		}
+		fair[c.Topic] = c.FairQueue
+		r.classes[c.Name] = &c
+	}
+	if r.classes[r.Default] == nil {
+		return nil, fmt.Errorf("default routing class %q is not defined", def)
+	}
+	return r, nil
+}
+
+// LegacyRouting is the NORMAL and PRIORITY pair the service had before
+// routing classes were configurable.
+func LegacyRouting(topicNormal, topicPriority string) (*Routing, error) {
+	return NewRouting("NORMAL", []RoutingClass{
+		{Name: "NORMAL", Topic: topicNormal, PriceColumn: PriceColumnNormal, FairQueue: true},
+		{Name: "PRIORITY", Topic: topicPriority, PriceColumn: PriceColumnPriority, MaskBody: true},
+	})
+}
+
+// Class returns the class called name, or nil.
+func (r *Routing) Class(name string) *RoutingClass {
+	return r.classes[strings.ToUpper(strings.TrimSpace(name))]
+}
+
+// Topics lists the distinct topics of the classes, sorted.
+func (r *Routing) Topics() []string {
+	seen := map[string]bool{}
+	var topics []string
+	for _, c := range r.classes {
+		if !seen[c.Topic] {
+			seen[c.Topic] = true
+			topics = append(topics, c.Topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// FairTopics lists the topics whose classes are fair-queued, sorted.
+func (r *Routing) FairTopics() []string {
+	var topics []string
+	for _, t := range r.Topics() {
+		for _, c := range r.classes {
+			if c.Topic == t && c.FairQueue {
+				topics = append(topics, t)
+				break
+			}
+		}
+	}
+	return topics
+}
+
+// classFor resolves the type of a new message, applying the default and
+// the class's allow-list.
+func (a *API) classFor(clientID, typ string) (*RoutingClass, error) {
+	if strings.TrimSpace(typ) == "" {
+		typ = a.Routing.Default
+	}
+	c := a.Routing.Class(typ)
+	if c == nil {
+		return nil, refuse(http.StatusBadRequest, "unknown_type", strings.ToUpper(typ))
+	}
+	if !c.allows(clientID) {
+		return nil, refuse(http.StatusForbidden, "type_not_allowed", c.Name)
+	}
+	return c, nil
+}
+
+// unitPrice is what one SMS part of class c costs.
+func (a *API) unitPrice(c *RoutingClass) int64 {
+	if c.PriceColumn == PriceColumnPriority {
+		return a.PricePriority
+	}
+	return a.PriceNormal
+}
+
+// topicFor returns the topic typ is routed to, or "" for types no longer
+// in the routing config.
+func (a *API) topicFor(typ string) string {
+	c := a.Routing.Class(typ)
+	if c == nil || a.Writers[c.Topic] == nil {
+		return ""
+	}
+	return c.Topic
+}
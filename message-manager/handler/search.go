@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageTerm is one entry of the search index: a token for a word of a
+// message's body or a prefix of its recipient. With encryption at rest the
+// tokens are keyed hashes (see Keyring), so the index holds no plaintext
+// and supports whole-word and prefix matches only, not substrings.
+type MessageTerm struct {
+	MessageID int    `gorm:"primaryKey;autoIncrement:false"`
+	Token     string `gorm:"primaryKey;size:64;index:idx_term_client_token,priority:2"`
+	ClientID  string `gorm:"size:64;index:idx_term_client_token,priority:1"`
+}
+
+const (
+	minWordLen      = 2
+	maxWordLen      = 32
+	maxWordsIndexed = 64
+	minPrefixLen    = 3
+)
+
+// searchWords splits text into lower-cased, de-duplicated words.
+func searchWords(text string) []string {
+	seen := map[string]bool{}
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		n := runeCount(w)
+		if n < minWordLen || n > maxWordLen || seen[w] {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+	}
+	return words
+}
+
+func recipientDigits(to string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, normalizeRecipient(to))
+}
+
+// searchToken turns a term into what is stored in MessageTerm.Token: an
+// HMAC under the keyring's index key, or a plain hash without a keyring.
+// Turning encryption on (or changing the index key) therefore needs the
+// message_terms table emptied and ReindexMessages run.
+func searchToken(term string) string {
+	var sum []byte
+	if k := keyring.Load(); k != nil {
+		mac := hmac.New(sha256.New, k.indexKey)
+		mac.Write([]byte(term))
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256([]byte(term))
+		sum = s[:]
+	}
+	return hex.EncodeToString(sum)
+}
+
+func wordToken(w string) string   { return searchToken("w:" + w) }
+func prefixToken(p string) string { return searchToken("p:" + p) }
+
+// indexMessage writes m's search terms; m must hold plaintext.
+func indexMessage(tx *gorm.DB, m *Message) error {
+	var terms []MessageTerm
+	words := searchWords(m.Body)
+	if len(words) > maxWordsIndexed {
+		words = words[:maxWordsIndexed]
+	}
+	for _, w := range words {
+		terms = append(terms, MessageTerm{MessageID: m.ID, ClientID: m.ClientID, Token: wordToken(w)})
+	}
+	digits := recipientDigits(m.To)
+	for n := minPrefixLen; n <= len(digits); n++ {
+		terms = append(terms, MessageTerm{MessageID: m.ID, ClientID: m.ClientID, Token: prefixToken(digits[:n])})
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&terms).Error
+}
+
+// ReindexMessages indexes up to limit messages after afterID that have no
+// search terms yet (those stored before the index existed). It returns how
+// many it indexed and the last ID it looked at, to pass as afterID next;
+// 0 messages means it is done.
+func (a *API) ReindexMessages(afterID, limit int) (int, int, error) {
+	msgs, err := a.Messages.Find(context.Background(), MessageQuery{AfterID: afterID, Unindexed: true, Order: ByID, Limit: limit})
+	if err != nil {
+		return 0, afterID, err
+	}
+	for i := range msgs {
+		if err := indexMessage(a.DB, &msgs[i]); err != nil {
+			return i, afterID, err
+		}
+		afterID = msgs[i].ID
+	}
+	return len(msgs), afterID, nil
+}
+
+// SearchFilter selects messages for Search. Words in Query must all
+// appear in the body; Recipient matches the whole number and
+// RecipientPrefix its leading digits. An empty ClientID searches every
+// client.
+type SearchFilter struct {
+	ClientID        string
+	Recipient       string
+	RecipientPrefix string
+	Query           string
+	Operator        string
+	Status          string
+	Type            string
+	Since, Until    time.Time
+	Limit, Page     int
+}
+
+var errEmptySearch = refuse(http.StatusBadRequest, "invalid_search", "q has no word of at least 2 characters")
+
+// Search returns a page of messages matching f, newest first.
+func (a *API) Search(f SearchFilter) ([]Message, SearchFilter, error) {
+	if f.Limit <= 0 {
+		f.Limit = 20
+	}
+	if f.Limit > 100 {
+		f.Limit = 100
+	}
+	if f.Page < 0 {
+		f.Page = 0
+	}
+
+	q := MessageQuery{ClientID: f.ClientID, Operator: f.Operator, Since: f.Since, Until: f.Until, To: f.Recipient, Order: NewestFirst, Limit: f.Limit, Page: f.Page}
+	if s := strings.ToUpper(strings.TrimSpace(f.Status)); knownStatus(s) {
+		q.Status = s
+	}
+	q.Type = strings.ToUpper(strings.TrimSpace(f.Type))
+	if k := keyring.Load(); k != nil && f.Recipient != "" {
+		q.ToHash = k.blindIndex(f.Recipient)
+	}
+
+	var tokens []string
+	if p := recipientDigits(f.RecipientPrefix); p != "" {
+		if len(p) < minPrefixLen {
+			return nil, f, refuse(http.StatusBadRequest, "invalid_search", "recipient_prefix needs at least 3 digits")
+		}
+		tokens = append(tokens, prefixToken(p))
+	}
+	if strings.TrimSpace(f.Query) != "" {
+		words := searchWords(f.Query)
+		if len(words) == 0 {
+			return nil, f, errEmptySearch
+		}
+		for _, w := range words {
+			tokens = append(tokens, wordToken(w))
+		}
+	}
+	q.Terms = tokens
+	msgs, err := a.Messages.Find(context.Background(), q)
+	return msgs, f, err
+}
+
+// searchFilter reads the query parameters shared by both search routes.
+func searchFilter(c *gin.Context) (SearchFilter, bool) {
+	f := SearchFilter{
+		Recipient:       c.Query("recipient"),
+		RecipientPrefix: c.Query("recipient_prefix"),
+		Query:           c.Query("q"),
+		Operator:        c.Query("operator"),
+		Status:          c.Query("status"),
+		Type:            c.Query("type"),
+	}
+	f.Limit, _ = strconv.Atoi(c.Query("limit"))
+	f.Page, _ = strconv.Atoi(c.Query("page"))
+	for key, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := c.Query(key); v != "" {
+			t, err := parseStatsTime(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_search", Detail: key + " must be an RFC 3339 time or YYYY-MM-DD"})
+				return f, false
+			}
+			*dst = t
+		}
+	}
+	return f, true
+}
+
+func (a *API) writeSearch(c *gin.Context, f SearchFilter, mask bool) {
+	msgs, f, err := a.Search(f)
+	if err == nil && mask {
+		err = a.maskBodies(f.ClientID, msgs)
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	if msgs == nil {
+		msgs = []Message{}
+	}
+	c.JSON(http.StatusOK, MessageList{Items: msgs, Page: f.Page, Limit: f.Limit, Count: len(msgs)})
+}
+
+// SearchMyMessages searches the caller's messages.
+func (a *API) SearchMyMessages(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	f, ok := searchFilter(c)
+	if !ok {
+		return
+	}
+	f.ClientID = clientID
+	a.writeSearch(c, f, true)
+}
+
+// AdminSearchMessages searches every client's messages, or one
+// ?client_id=. Bodies are never masked here.
+func (a *API) AdminSearchMessages(c *gin.Context) {
+	f, ok := searchFilter(c)
+	if !ok {
+		return
+	}
+	f.ClientID = c.Query("client_id")
+	a.writeSearch(c, f, false)
+}
+
+func (a *API) ReindexMessagesHandler(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if limit <= 0 || limit > 10000 {
+		limit = 1000
+	}
+	after, _ := strconv.Atoi(c.Query("after"))
+	n, last, err := a.ReindexMessages(after, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "reindex_failed", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"indexed": n, "last_id": last})
+}
@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"message-manager/logging"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SendError is a refused request. Status is the HTTP status the REST
+// handlers answer with; the gRPC server maps it to a status code.
+type SendError struct {
+	Status     int
+	Code       string
+	Detail     string
+	RetryAfter int // seconds, for 503s
+}
+
+func (e *SendError) Error() string {
+	if e.Detail == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Detail
+}
+
+func refuse(status int, code, detail string) *SendError {
+	return &SendError{Status: status, Code: code, Detail: detail}
+}
+
+// unavailableError refuses with 503 because a dependency or queue cannot
+// take the message now; the caller should retry after retryAfter seconds.
+func unavailableError(code, detail string, retryAfter int) *SendError {
+	return &SendError{Status: http.StatusServiceUnavailable, Code: code, Detail: detail, RetryAfter: max(1, retryAfter)}
+}
+
+// writeError answers a REST request with err, using its SendError status
+// when it has one.
+func writeError(c *gin.Context, err error) {
+	var se *SendError
+	if errors.As(err, &se) {
+		if se.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(se.RetryAfter))
+		}
+		c.JSON(se.Status, ErrorResponse{Error: se.Code, Detail: se.Detail})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "internal_error", Detail: err.Error()})
+}
+
+// prepared is a validated and priced message that has not been stored yet.
+type prepared struct {
+	req    CreateMessageRequest
+	class  *RoutingClass
+	body   string // after URL shortening
+	links  []ShortLink
+	action string
+	rule   *FilterRule
+	price  int64
+}
+
+// prepare runs every check a message goes through before money is
+// reserved: routing class, sender, content rules, URL shortening and
+// length.
+func (a *API) prepare(clientID string, req CreateMessageRequest) (*prepared, error) {
+	if len(req.To) == 0 || req.Body == "" {
+		return nil, refuse(http.StatusBadRequest, "to and body are required", "")
+	}
+	if err := validRecipients(req.To); err != nil {
+		return nil, err
+	}
+	class, err := a.classFor(clientID, req.Type)
+	if err != nil {
+		return nil, err
+	}
+	req.Type = class.Name
+	req.From = strings.TrimSpace(req.From)
+	if req.From == "" && class.RequireSender {
+		return nil, refuse(http.StatusUnprocessableEntity, "sender_required", class.Name)
+	}
+	if req.From != "" {
+		if err := a.approvedSender(clientID, req.From); err != nil {
+			if errors.Is(err, errSenderNotApproved) {
+				return nil, refuse(http.StatusUnprocessableEntity, "sender_not_approved", req.From)
+			}
+			return nil, err
+		}
+	}
+
+	if class.NoURLs && urlRe.MatchString(req.Body) {
+		return nil, refuse(http.StatusUnprocessableEntity, "urls_not_allowed", class.Name)
+	}
+
+	action, rule, err := a.checkContent(clientID, req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if action == ActionBlock {
+		return nil, refuse(http.StatusUnprocessableEntity, "content_blocked", blockedDetail(rule))
+	}
+
+	// filters see the original URLs; the length limit applies to what is sent
+	p := &prepared{req: req, class: class, body: req.Body, action: action, rule: rule}
+	if req.ShortenURLs {
+		if a.ShortLinkBase == "" {
+			return nil, refuse(http.StatusBadRequest, "shorten_urls_unavailable", "no short link base is configured")
+		}
+		if p.body, p.links, err = a.shortenBody(req.Body, clientID, req.Campaign); err != nil {
+			return nil, err
+		}
+	}
+	if max := class.maxLength(); runeCount(p.body) > max {
+		if max <= defaultMaxLength {
+			return nil, refuse(http.StatusBadRequest, fmt.Sprintf("single-page only (<=%d chars)", max), "")
+		}
+		return nil, refuse(http.StatusBadRequest, "body_too_long", fmt.Sprintf("at most %d chars for %s", max, class.Name))
+	}
+
+	p.price = a.unitPrice(class) * int64(segments(p.body))
+	return p, nil
+}
+
+// Send validates, stores and reserves money for one message and hands it
+// to the publisher (or to the review queue when a HOLD rule matched).
+// Both the REST and the gRPC API go through here.
+func (a *API) Send(ctx context.Context, clientID string, req CreateMessageRequest) (Message, error) {
+	if len(req.To) > 1 {
+		return Message{}, refuse(http.StatusBadRequest, "single recipient only", "use SendMulti")
+	}
+	p, err := a.prepare(clientID, req)
+	if err != nil {
+		return Message{}, err
+	}
+	if err := a.admit(clientID, p, 1); err != nil {
+		return Message{}, err
+	}
+	now := time.Now()
+	m := &Message{ClientID: clientID, From: p.req.From, To: p.req.To[0], Body: p.body, Type: p.req.Type, PriceMinor: p.price, Status: "CREATED", Campaign: p.req.Campaign, TraceParent: traceParent(ctx), RequestID: logging.Field(ctx, logging.RequestID), CreatedAt: now, UpdatedAt: now}
+	if p.action == ActionHold {
+		// held for review: reserved now, published only once approved
+		m.Status = "HELD"
+		m.HeldByRule = &p.rule.ID
+	}
+	// reserved before the insert and outside its transaction; a failed
+	// insert releases the hold, and one lost in a crash expires
+	m.ReservationRef = newReservationRef()
+	resID, err := a.reserve(ctx, clientID, p.price, m.ReservationRef)
+	if err != nil {
+		if errors.Is(err, errInsufficientFunds) {
+			return Message{}, refuse(http.StatusPaymentRequired, "insufficient_funds", "")
+		}
+		return Message{}, err
+	}
+	m.ReservationID = resID
+	links := p.links
+	if err := a.Messages.Tx(ctx, func(tx *MessageTx) error {
+		if err := tx.Create(m); err != nil {
+			return err
+		}
+		if err := rollStats(tx.db, m, "", ""); err != nil {
+			return err
+		}
+		if err := indexMessage(tx.db, m); err != nil {
+			return err
+		}
+		for i := range links {
+			links[i].MessageID = m.ID
+		}
+		if len(links) > 0 {
+			return tx.db.Create(&links).Error
+		}
+		return nil
+	}); err != nil {
+		if resID != "" {
+			_ = a.release(ctx, clientID, resID, 0, m.ReservationRef)
+		}
+		return Message{}, err
+	}
+	messagesCreated.WithLabelValues(m.Type, m.Status).Inc()
+	slog.InfoContext(logging.With(ctx, logging.MessageID, msgRef(m.ID)), "message stored", "status", m.Status, "type", m.Type, "price_minor", m.PriceMinor)
+	a.notify(*m)
+	if m.Status == "CREATED" && !a.enqueue(*m) {
+		slog.WarnContext(ctx, "publish queue full; left for the reconciler", logging.MessageID, msgRef(m.ID))
+	}
+	return *m, nil
+}
+
+// ListFilter selects a page of a client's messages. Zero values mean the
+// defaults; ListMessages returns the filter it actually applied.
+type ListFilter struct {
+	Limit  int
+	Page   int
+	Type   string
+	Status string
+}
+
+func (a *API) ListMessages(clientID string, f ListFilter) ([]Message, ListFilter, error) {
+	if f.Limit <= 0 {
+		f.Limit = 20
+	}
+	if f.Limit > 100 {
+		f.Limit = 100
+	}
+	if f.Page < 0 {
+		f.Page = 0
+	}
+	f.Type = strings.ToUpper(strings.TrimSpace(f.Type))
+	f.Status = strings.ToUpper(strings.TrimSpace(f.Status))
+
+	// unknown types and statuses filter nothing
+	q := MessageQuery{ClientID: clientID, Type: f.Type, Status: f.Status, Order: NewestFirst, Limit: f.Limit, Page: f.Page}
+	if a.Routing.Class(q.Type) == nil {
+		q.Type = ""
+	}
+	if !knownStatus(q.Status) {
+		q.Status = ""
+	}
+	msgs, err := a.Messages.Find(context.Background(), q)
+	if err != nil {
+		return nil, f, err
+	}
+	return msgs, f, a.maskBodies(clientID, msgs)
+}
+
+// GetClientMessage returns one of the client's messages.
+func (a *API) GetClientMessage(clientID, id string) (Message, error) {
+	m, err := a.Messages.Get(context.Background(), clientID, id)
+	if err != nil {
+		return m, err
+	}
+	one := []Message{m}
+	err = a.maskBodies(clientID, one)
+	return one[0], err
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Sender is an originator (alphanumeric sender ID or long number) a client
+// may put in the `from` of a message once an admin has approved it.
+type Sender struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	ClientID  string    `gorm:"size:64;uniqueIndex:idx_sender_client_value" json:"client_id"`
+	Value     string    `gorm:"size:16;uniqueIndex:idx_sender_client_value" json:"value"`
+	Kind      string    `json:"kind"`   // ALPHANUMERIC|NUMERIC
+	Status    string    `json:"status"` // PENDING|APPROVED|REJECTED
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SenderList struct {
+	Items []Sender `json:"items"`
+	Count int      `json:"count"`
+}
+
+type RegisterSenderRequest struct {
+	Value string `json:"value" binding:"required"`
+}
+
+var (
+	alnumSenderRe   = regexp.MustCompile(`^[A-Za-z0-9 ]{1,11}$`)
+	numericSenderRe = regexp.MustCompile(`^\+?[0-9]{3,15}$`)
+	hasLetterRe     = regexp.MustCompile(`[A-Za-z]`)
+)
+
+// senderKind classifies an originator, returning "" when it is not valid.
+func senderKind(v string) string {
+	switch {
+	case numericSenderRe.MatchString(v):
+		return "NUMERIC"
+	case alnumSenderRe.MatchString(v) && hasLetterRe.MatchString(v):
+		return "ALPHANUMERIC"
+	}
+	return ""
+}
+
+var errSenderNotApproved = errors.New("sender_not_approved")
+
+// approvedSender checks that from is one of the client's approved senders.
+func (a *API) approvedSender(clientID, from string) error {
+	var s Sender
+	err := a.DB.First(&s, "client_id = ? AND value = ? AND status = ?", clientID, from, "APPROVED").Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errSenderNotApproved
+	}
+	return err
+}
+
+func (a *API) RegisterSender(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	var req RegisterSenderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	v := strings.TrimSpace(req.Value)
+	kind := senderKind(v)
+	if kind == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_sender", Detail: "1-11 alphanumeric chars with a letter, or a 3-15 digit number"})
+		return
+	}
+
+	now := time.Now()
+	var s Sender
+	err := a.DB.First(&s, "client_id = ? AND value = ?", clientID, v).Error
+	switch {
+	case err == nil && s.Status != "REJECTED":
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "sender_exists", Detail: s.Status})
+		return
+	case err == nil:
+		// a rejected sender may be submitted again for review
+		s.Status = "PENDING"
+		s.UpdatedAt = now
+		err = a.DB.Save(&s).Error
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		s = Sender{ClientID: clientID, Value: v, Kind: kind, Status: "PENDING", CreatedAt: now, UpdatedAt: now}
+		err = a.DB.Create(&s).Error
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+func (a *API) ListMySenders(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	var senders []Sender
+	if err := a.DB.Where("client_id = ?", clientID).Order("id").Find(&senders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, SenderList{Items: senders, Count: len(senders)})
+}
+
+func (a *API) ListSenders(c *gin.Context) {
+	q := a.DB.Order("id")
+	if v := strings.ToUpper(c.Query("status")); v != "" {
+		q = q.Where("status = ?", v)
+	}
+	if v := c.Query("client_id"); v != "" {
+		q = q.Where("client_id = ?", v)
+	}
+	var senders []Sender
+	if err := q.Find(&senders).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": senders, "count": len(senders)})
+}
+
+func (a *API) ApproveSender(c *gin.Context) { a.decideSender(c, "APPROVED") }
+func (a *API) RejectSender(c *gin.Context)  { a.decideSender(c, "REJECTED") }
+
+func (a *API) decideSender(c *gin.Context, status string) {
+	var s Sender
+	if err := a.DB.First(&s, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
+		return
+	}
+	s.Status = status
+	s.UpdatedAt = time.Now()
+	if err := a.DB.Save(&s).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
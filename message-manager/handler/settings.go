@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ClientSetting holds a client's preferences for how message-manager
+// treats its messages. A client without a row has the zero settings.
+type ClientSetting struct {
+	ClientID string `gorm:"primaryKey;size:64" json:"client_id"`
+	// MaskPriorityBodies hides the body of messages whose routing class
+	// has mask_body set (typically OTP codes) in list and get responses.
+	MaskPriorityBodies bool `json:"mask_priority_bodies"`
+	// RetentionDays is how long finalized messages stay in the messages
+	// table before they are archived; 0 means the service default.
+	RetentionDays int       `json:"retention_days"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type UpdateSettingsRequest struct {
+	MaskPriorityBodies *bool `json:"mask_priority_bodies"`
+	RetentionDays      *int  `json:"retention_days"`
+}
+
+// maxRetentionDays bounds RetentionDays at ten years.
+const maxRetentionDays = 3650
+
+func (a *API) clientSettings(clientID string) (ClientSetting, error) {
+	s := ClientSetting{ClientID: clientID}
+	err := a.DB.First(&s, "client_id = ?", clientID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s, nil
+	}
+	return s, err
+}
+
+// maskBodies blanks the bodies the client asked to hide.
+func (a *API) maskBodies(clientID string, msgs []Message) error {
+	s, err := a.clientSettings(clientID)
+	if err != nil || !s.MaskPriorityBodies {
+		return err
+	}
+	for i := range msgs {
+		if c := a.Routing.Class(msgs[i].Type); c != nil && c.MaskBody {
+			msgs[i].Body, msgs[i].BodyMasked = "", true
+		}
+	}
+	return nil
+}
+
+func (a *API) GetSettings(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	s, err := a.clientSettings(clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+func (a *API) UpdateSettings(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	var req UpdateSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if d := req.RetentionDays; d != nil && (*d < 0 || *d > maxRetentionDays) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_retention", Detail: fmt.Sprintf("retention_days must be between 0 and %d", maxRetentionDays)})
+		return
+	}
+	var s ClientSetting
+	err := a.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&s, "client_id = ?", clientID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s = ClientSetting{ClientID: clientID}
+		} else if err != nil {
+			return err
+		}
+		if req.MaskPriorityBodies != nil {
+			s.MaskPriorityBodies = *req.MaskPriorityBodies
+		}
+		if req.RetentionDays != nil {
+			s.RetentionDays = *req.RetentionDays
+		}
+		s.UpdatedAt = time.Now()
+		return tx.Save(&s).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// RewrapKeysHandler moves up to ?limit= messages onto the active KEK; see
+// RewrapKeys.
+func (a *API) RewrapKeysHandler(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if limit <= 0 || limit > 10000 {
+		limit = 1000
+	}
+	n, err := a.RewrapKeys(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "rewrap_failed", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rewrapped": n})
+}
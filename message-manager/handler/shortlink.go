@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShortLink maps a short code to the original URL of one message.
+type ShortLink struct {
+	Code      string    `gorm:"primaryKey;size:16" json:"code"`
+	MessageID int       `gorm:"index" json:"message_id"`
+	ClientID  string    `gorm:"size:64;index" json:"client_id"`
+	Campaign  string    `gorm:"size:64;index" json:"campaign,omitempty"`
+	TargetURL string    `gorm:"size:2048" json:"target_url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Click is one redirect served for a short link.
+type Click struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	Code      string    `gorm:"size:16;index" json:"code"`
+	MessageID int       `gorm:"index" json:"message_id"`
+	ClientID  string    `gorm:"size:64" json:"client_id"`
+	Campaign  string    `gorm:"size:64;index" json:"campaign,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `gorm:"size:512" json:"user_agent"`
+	At        time.Time `json:"at"`
+}
+
+type LinkClicks struct {
+	Code      string `json:"code"`
+	MessageID int    `json:"message_id"`
+	TargetURL string `json:"target_url"`
+	Clicks    int64  `json:"clicks"`
+}
+
+type MessageClickStats struct {
+	MessageID   int          `json:"message_id"`
+	Links       []LinkClicks `json:"links"`
+	TotalClicks int64        `json:"total_clicks"`
+}
+
+type CampaignClickStats struct {
+	Campaign        string       `json:"campaign"`
+	Messages        int          `json:"messages"`
+	MessagesClicked int          `json:"messages_clicked"`
+	TotalClicks     int64        `json:"total_clicks"`
+	Links           []LinkClicks `json:"links"`
+}
+
+var urlRe = regexp.MustCompile(`(?i)\bhttps?://[^\s]+`)
+
+const codeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func newCode(n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(codeAlphabet)))
+	for i := range b {
+		k, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = codeAlphabet[k.Int64()]
+	}
+	return string(b), nil
+}
+
+// shortenBody replaces every http(s) URL in body with a fresh short link.
+// The returned links still need MessageID set before they are stored.
+func (a *API) shortenBody(body, clientID, campaign string) (string, []ShortLink, error) {
+	var links []ShortLink
+	var genErr error
+	out := urlRe.ReplaceAllStringFunc(body, func(u string) string {
+		if genErr != nil {
+			return u
+		}
+		u, tail := trimURL(u)
+		code, err := newCode(8)
+		if err != nil {
+			genErr = err
+			return u + tail
+		}
+		links = append(links, ShortLink{Code: code, ClientID: clientID, Campaign: campaign, TargetURL: u, CreatedAt: time.Now()})
+		return a.ShortLinkBase + code + tail
+	})
+	return out, links, genErr
+}
+
+// trimURL splits off the punctuation urlRe takes along from the sentence
+// around a URL, as in "see https://x.com/a." or "(https://x.com/a)".
+// Closing brackets stay when the URL opened them.
+func trimURL(u string) (string, string) {
+	end := len(u)
+	for end > 0 {
+		c := u[end-1]
+		switch {
+		case strings.IndexByte(".,;:!?'\"", c) >= 0:
+		case c == ')' && strings.Count(u[:end], "(") < strings.Count(u[:end], ")"):
+		case c == ']' && strings.Count(u[:end], "[") < strings.Count(u[:end], "]"):
+		default:
+			return u[:end], u[end:]
+		}
+		end--
+	}
+	return u[:end], u[end:]
+}
+
+// FollowShortLink records a click and redirects to the original URL.
+func (a *API) FollowShortLink(c *gin.Context) {
+	var l ShortLink
+	if err := a.DB.First(&l, "code = ?", c.Param("code")).Error; err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
+		return
+	}
+	click := Click{Code: l.Code, MessageID: l.MessageID, ClientID: l.ClientID, Campaign: l.Campaign, IP: c.ClientIP(), UserAgent: c.Request.UserAgent(), At: time.Now()}
+	if err := a.DB.Create(&click).Error; err != nil {
+		// never break the redirect over bookkeeping
+		_ = c.Error(err)
+	}
+	c.Redirect(http.StatusFound, l.TargetURL)
+}
+
+func (a *API) linkClicks(where string, args ...any) ([]LinkClicks, int64, error) {
+	var rows []LinkClicks
+	err := a.DB.Table("short_links AS l").
+		Select("l.code, l.message_id, l.target_url, COUNT(c.id) AS clicks").
+		Joins("LEFT JOIN clicks c ON c.code = l.code").
+		Where(where, args...).
+		Group("l.code, l.message_id, l.target_url").
+		Order("l.message_id, l.code").
+		Scan(&rows).Error
+	var total int64
+	for _, r := range rows {
+		total += r.Clicks
+	}
+	return rows, total, err
+}
+
+func (a *API) MessageClicks(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "not_found"})
+		return
+	}
+	links, total, err := a.linkClicks("l.message_id = ? AND l.client_id = ?", id, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, MessageClickStats{MessageID: id, Links: links, TotalClicks: total})
+}
+
+func (a *API) CampaignClicks(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	campaign := c.Param("campaign")
+	links, total, err := a.linkClicks("l.campaign = ? AND l.client_id = ?", campaign, clientID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	clicked := map[int]bool{}
+	msgs := map[int]bool{}
+	for _, l := range links {
+		msgs[l.MessageID] = true
+		if l.Clicks > 0 {
+			clicked[l.MessageID] = true
+		}
+	}
+	c.JSON(http.StatusOK, CampaignClickStats{
+		Campaign:        campaign,
+		Messages:        len(msgs),
+		MessagesClicked: len(clicked),
+		TotalClicks:     total,
+		Links:           links,
+	})
+}
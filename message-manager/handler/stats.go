@@ -0,0 +1,405 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageStat is an hourly rollup of a client's messages: how many created
+// in the hour (UTC) currently have a given type, status and operator, and
+// what they are priced at. Every status change moves a message from one
+// row to another in the transaction that makes it, so GET /stats never
+// has to scan messages.
+type MessageStat struct {
+	ClientID   string    `gorm:"primaryKey;size:64"`
+	Bucket     time.Time `gorm:"primaryKey"`
+	Type       string    `gorm:"primaryKey;size:16"`
+	Status     string    `gorm:"primaryKey;size:16"`
+	Operator   string    `gorm:"primaryKey;size:64"`
+	Messages   int64
+	SpendMinor int64
+}
+
+type StatsPoint struct {
+	Bucket     time.Time `json:"bucket"`
+	Status     string    `json:"status,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	Operator   string    `json:"operator,omitempty"`
+	Messages   int64     `json:"messages"`
+	SpendMinor int64     `json:"spend_minor"`
+}
+
+type StatsTotals struct {
+	Messages  int64 `json:"messages"`
+	Delivered int64 `json:"delivered"`
+	Failed    int64 `json:"failed"` // FAILED and EXPIRED
+	// DeliveryRate is Delivered over messages that reached DELIVERED,
+	// FAILED or EXPIRED; 0 when none has.
+	DeliveryRate float64 `json:"delivery_rate"`
+	// SpendMinor is what was captured, i.e. the price of delivered messages.
+	SpendMinor int64 `json:"spend_minor"`
+}
+
+type StatsResponse struct {
+	From    time.Time    `json:"from"`
+	To      time.Time    `json:"to"`
+	Bucket  string       `json:"bucket"`
+	GroupBy []string     `json:"group_by"`
+	Series  []StatsPoint `json:"series"`
+	Totals  StatsTotals  `json:"totals"`
+}
+
+func statBucket(t time.Time) time.Time { return t.UTC().Truncate(time.Hour) }
+
+// rollStats moves m from the rollup row of its old status and operator to
+// that of its current ones. A new message has an empty fromStatus. It must
+// run in the transaction that changes the status.
+func rollStats(tx *gorm.DB, m *Message, fromStatus, fromOperator string) error {
+	if fromStatus != "" {
+		if err := bumpStat(tx, m, fromStatus, fromOperator, -1); err != nil {
+			return err
+		}
+	}
+	return bumpStat(tx, m, m.Status, m.Operator, 1)
+}
+
+// rollStatsBatch is rollStats for messages that all moved from fromStatus
+// to their current status without changing operator. It bumps each
+// rollup row once however many of msgs fall into it.
+func rollStatsBatch(tx *gorm.DB, msgs []Message, fromStatus string) error {
+	type key struct {
+		clientID, typ, status, operator string
+		bucket                          time.Time
+	}
+	sums := map[key]*MessageStat{}
+	var keys []key
+	for _, m := range msgs {
+		k := key{m.ClientID, m.Type, m.Status, m.Operator, statBucket(m.CreatedAt)}
+		s := sums[k]
+		if s == nil {
+			s = &MessageStat{ClientID: k.clientID, Bucket: k.bucket, Type: k.typ, Status: k.status, Operator: k.operator}
+			sums[k] = s
+			keys = append(keys, k)
+		}
+		s.Messages++
+		s.SpendMinor += m.PriceMinor
+	}
+	for _, k := range keys {
+		s := *sums[k]
+		if err := bumpStatRow(tx, s); err != nil {
+			return err
+		}
+		s.Status, s.Messages, s.SpendMinor = fromStatus, -s.Messages, -s.SpendMinor
+		if err := bumpStatRow(tx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bumpStat(tx *gorm.DB, m *Message, status, operator string, delta int64) error {
+	return bumpStatRow(tx, MessageStat{
+		ClientID: m.ClientID, Bucket: statBucket(m.CreatedAt), Type: m.Type, Status: status, Operator: operator,
+		Messages: delta, SpendMinor: delta * m.PriceMinor,
+	})
+}
+
+// bumpStatRow adds row's counts to the rollup row with the same key.
+func bumpStatRow(tx *gorm.DB, row MessageStat) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "client_id"}, {Name: "bucket"}, {Name: "type"}, {Name: "status"}, {Name: "operator"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"messages":    gorm.Expr("messages + ?", row.Messages),
+			"spend_minor": gorm.Expr("spend_minor + ?", row.SpendMinor),
+		}),
+	}).Create(&row).Error
+}
+
+// RebuildStats recomputes the rollup rows of the hours in [from, to) from
+// the messages table and the archives, so archived messages keep their
+// counts. A zero from or to leaves that end open; both are widened to whole
+// hours. It is meant for the first deployment of the rollup (messages
+// created before it have no rows) and for repairs; status changes that
+// commit while it runs may be counted twice or not at all, so run it when
+// traffic is quiet.
+func (a *API) RebuildStats(from, to time.Time) (int, error) {
+	if !from.IsZero() {
+		from = statBucket(from)
+	}
+	if !to.IsZero() && !statBucket(to).Equal(to) {
+		to = statBucket(to).Add(time.Hour)
+	}
+	inRange := func(q *gorm.DB, col string) *gorm.DB {
+		if !from.IsZero() {
+			q = q.Where(col+" >= ?", from)
+		}
+		if !to.IsZero() {
+			q = q.Where(col+" < ?", to)
+		}
+		return q
+	}
+
+	type key struct {
+		clientID, typ, status, operator string
+		bucket                          time.Time
+	}
+	sums := map[key]*MessageStat{}
+	add := func(m Message) {
+		k := key{m.ClientID, m.Type, m.Status, m.Operator, statBucket(m.CreatedAt)}
+		s := sums[k]
+		if s == nil {
+			s = &MessageStat{ClientID: k.clientID, Bucket: k.bucket, Type: k.typ, Status: k.status, Operator: k.operator}
+			sums[k] = s
+		}
+		s.Messages++
+		s.SpendMinor += m.PriceMinor
+	}
+
+	err := a.Messages.EachStored(context.Background(), MessageQuery{Since: from, Until: to}, func(batch []Message) error {
+		for _, m := range batch {
+			add(m)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// archives are by month of creation; only their messages in range count
+	arcQ := a.DB.Model(&MessageArchive{})
+	if !from.IsZero() {
+		arcQ = arcQ.Where("period >= ?", archivePeriod(from))
+	}
+	if !to.IsZero() {
+		arcQ = arcQ.Where("period <= ?", archivePeriod(to.Add(-time.Nanosecond)))
+	}
+	var arcs []MessageArchive
+	err = arcQ.FindInBatches(&arcs, 10, func(*gorm.DB, int) error {
+		for _, arc := range arcs {
+			msgs, err := decodeArchive(arc.Data)
+			if err != nil {
+				return fmt.Errorf("archive %d: %w", arc.ID, err)
+			}
+			for _, m := range msgs {
+				if (from.IsZero() || !m.CreatedAt.Before(from)) && (to.IsZero() || m.CreatedAt.Before(to)) {
+					add(m)
+				}
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	rows := make([]MessageStat, 0, len(sums))
+	for _, s := range sums {
+		rows = append(rows, *s)
+	}
+	err = a.DB.Transaction(func(tx *gorm.DB) error {
+		if err := inRange(tx.Where("1 = 1"), "bucket").Delete(&MessageStat{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(rows, 500).Error
+	})
+	return len(rows), err
+}
+
+var statGroups = map[string]bool{"status": true, "type": true, "operator": true}
+
+const (
+	maxHourlyRange = 31 * 24 * time.Hour
+	maxDailyRange  = 366 * 24 * time.Hour
+)
+
+// parseStatsTime accepts RFC 3339 times and plain dates (midnight UTC).
+func parseStatsTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// Stats returns clientID's messages created in [from, to), bucketed by
+// hour or day (UTC) and grouped by any of status, type and operator.
+func (a *API) Stats(clientID string, from, to time.Time, bucket string, groupBy []string) (StatsResponse, error) {
+	resp := StatsResponse{From: from, To: to, Bucket: bucket, GroupBy: groupBy, Series: []StatsPoint{}}
+	var rows []MessageStat
+	if err := a.DB.Where("client_id = ? AND bucket >= ? AND bucket < ?", clientID, statBucket(from), to).
+		Find(&rows).Error; err != nil {
+		return resp, err
+	}
+	group := map[string]bool{}
+	for _, g := range groupBy {
+		group[g] = true
+	}
+	points := map[StatsPoint]*StatsPoint{}
+	for _, r := range rows {
+		if r.Messages == 0 {
+			continue
+		}
+		r.Bucket = r.Bucket.UTC()
+		k := StatsPoint{Bucket: r.Bucket}
+		if bucket == "day" {
+			k.Bucket = time.Date(r.Bucket.Year(), r.Bucket.Month(), r.Bucket.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		if group["status"] {
+			k.Status = r.Status
+		}
+		if group["type"] {
+			k.Type = r.Type
+		}
+		if group["operator"] {
+			k.Operator = r.Operator
+		}
+		p := points[k]
+		if p == nil {
+			p = &StatsPoint{Bucket: k.Bucket, Status: k.Status, Type: k.Type, Operator: k.Operator}
+			points[k] = p
+		}
+		p.Messages += r.Messages
+		p.SpendMinor += r.SpendMinor
+
+		t := &resp.Totals
+		t.Messages += r.Messages
+		switch r.Status {
+		case "DELIVERED":
+			t.Delivered += r.Messages
+			t.SpendMinor += r.SpendMinor
+		case "FAILED", "EXPIRED":
+			t.Failed += r.Messages
+		}
+	}
+	for _, p := range points {
+		resp.Series = append(resp.Series, *p)
+	}
+	sort.Slice(resp.Series, func(i, j int) bool {
+		a, b := resp.Series[i], resp.Series[j]
+		if !a.Bucket.Equal(b.Bucket) {
+			return a.Bucket.Before(b.Bucket)
+		}
+		if a.Status != b.Status {
+			return a.Status < b.Status
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Operator < b.Operator
+	})
+	if done := resp.Totals.Delivered + resp.Totals.Failed; done > 0 {
+		resp.Totals.DeliveryRate = float64(resp.Totals.Delivered) / float64(done)
+	}
+	return resp, nil
+}
+
+// GetStats serves GET /stats?from=&to=&bucket=hour|day&group_by=status,type.
+// The range defaults to the last 7 days and is capped at 31 days for
+// hourly and 366 days for daily buckets.
+func (a *API) GetStats(c *gin.Context) {
+	clientID := c.GetHeader("X-Client-ID")
+	if clientID == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "missing X-Client-ID"})
+		return
+	}
+	bad := func(detail string) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_stats_query", Detail: detail})
+	}
+
+	to := time.Now().UTC()
+	if v := c.Query("to"); v != "" {
+		t, err := parseStatsTime(v)
+		if err != nil {
+			bad("to must be an RFC 3339 time or YYYY-MM-DD")
+			return
+		}
+		to = t
+	}
+	from := to.Add(-7 * 24 * time.Hour)
+	if v := c.Query("from"); v != "" {
+		t, err := parseStatsTime(v)
+		if err != nil {
+			bad("from must be an RFC 3339 time or YYYY-MM-DD")
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		bad("from must be before to")
+		return
+	}
+
+	bucket := strings.ToLower(c.DefaultQuery("bucket", "day"))
+	limit := maxDailyRange
+	switch bucket {
+	case "day":
+	case "hour":
+		limit = maxHourlyRange
+	default:
+		bad("bucket must be hour or day")
+		return
+	}
+	if to.Sub(from) > limit {
+		bad(fmt.Sprintf("range longer than %d days for %s buckets", int(limit/(24*time.Hour)), bucket))
+		return
+	}
+
+	groupBy := []string{}
+	for _, g := range strings.Split(c.DefaultQuery("group_by", "status"), ",") {
+		g = strings.ToLower(strings.TrimSpace(g))
+		if g == "" {
+			continue
+		}
+		if !statGroups[g] {
+			bad("group_by takes status, type and operator")
+			return
+		}
+		groupBy = append(groupBy, g)
+	}
+
+	resp, err := a.Stats(clientID, from, to, bucket, groupBy)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "db_error", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RebuildStatsHandler rebuilds the rollup of the hours between ?from= and
+// ?to= (RFC 3339 times or dates; either may be left out), counting live
+// and archived messages. Without a range it replaces every row, which
+// reads every archive.
+func (a *API) RebuildStatsHandler(c *gin.Context) {
+	var from, to time.Time
+	for key, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		v := c.Query(key)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *t, err = parseStatsTime(v); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_range", Detail: key + " must be an RFC 3339 time or YYYY-MM-DD"})
+			return
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "invalid_range", Detail: "from must be before to"})
+		return
+	}
+	n, err := a.RebuildStats(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "rebuild_failed", Detail: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rows": n})
+}
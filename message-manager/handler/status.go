@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"message-manager/logging"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// transitions lists every legal status change. Anything not in here,
+// including a status moving to itself, is rejected.
+var transitions = map[string][]string{
+	"HELD":     {"CREATED", "REJECTED", "CANCELED"},
+	"CREATED":  {"QUEUED", "ACCEPTED", "DELIVERED", "FAILED", "EXPIRED"},
+	"QUEUED":   {"ACCEPTED", "DELIVERED", "FAILED", "EXPIRED"},
+	"ACCEPTED": {"DELIVERED", "FAILED", "EXPIRED"},
+	// DELIVERED, FAILED, EXPIRED, REJECTED and CANCELED are final
+}
+
+func knownStatus(s string) bool {
+	switch s {
+	case "HELD", "CREATED", "QUEUED", "ACCEPTED", "DELIVERED", "FAILED", "EXPIRED", "REJECTED", "CANCELED":
+		return true
+	}
+	return false
+}
+
+func canTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	errBadEvent          = errors.New("bad_event")
+	errUnknownStatus     = errors.New("unknown_status")
+	errIllegalTransition = errors.New("illegal_transition")
+	errStaleEvent        = errors.New("stale_event")
+	errDuplicateEvent    = errors.New("duplicate_event")
+)
+
+// applyStatus applies one status event under a row lock. Events older
+// than the last applied one, duplicates, unknown statuses and illegal
+// transitions are not applied; they are recorded as MessageEvents and the
+// reason is returned wrapped in the error.
+func (a *API) applyStatus(ctx context.Context, evt StatusEvent) error {
+	id, err := strconv.Atoi(evt.MessageID)
+	if err != nil {
+		return fmt.Errorf("%w: message_id %q", errBadEvent, evt.MessageID)
+	}
+	to := strings.ToUpper(strings.TrimSpace(evt.Status))
+	at := time.Now()
+	if evt.At != "" {
+		if at, err = time.Parse(time.RFC3339Nano, evt.At); err != nil {
+			return fmt.Errorf("%w: at %q", errBadEvent, evt.At)
+		}
+	}
+
+	var rejected error
+	msg, err := a.Messages.Transition(ctx, id, func(tx *MessageTx, msg *Message) error {
+		switch {
+		case !knownStatus(to):
+			rejected = errUnknownStatus
+		case msg.Status == to:
+			rejected = errDuplicateEvent
+		case msg.StatusAt != nil && at.Before(*msg.StatusAt):
+			rejected = errStaleEvent
+		case !canTransition(msg.Status, to):
+			rejected = errIllegalTransition
+		}
+		if rejected != nil {
+			detail := fmt.Sprintf("%s at %s", rejected, evt.At)
+			return a.recordEvent(tx.db, msg.ID, "STATUS_REJECTED", msg.Status, to, detail)
+		}
+
+		from, fromOperator := msg.Status, msg.Operator
+		msg.Status = to
+		msg.StatusAt = &at
+		if evt.Operator != "" {
+			msg.Operator = evt.Operator
+		}
+		msg.UpdatedAt = time.Now()
+		if err := tx.Save(msg); err != nil {
+			return err
+		}
+		if err := rollStats(tx.db, msg, from, fromOperator); err != nil {
+			return err
+		}
+		return a.settleOnce(ctx, tx, msg)
+	})
+	if err != nil {
+		return err
+	}
+	if rejected != nil {
+		return fmt.Errorf("message %d -> %s: %w", id, to, rejected)
+	}
+	a.notify(msg)
+	return nil
+}
+
+// StartStatusConsumer applies status events with at-least-once semantics:
+// an offset is committed only once its event has been applied (or
+// rejected by the state machine, or parked in the dead-letter topic).
+// Transient DB and client-manager errors are retried with backoff for as
+// long as ctx lives; poison events go to WStatusDLQ with the error in the
+// x-error header. An offset is only committed once its event is applied,
+// rejected or written to the DLQ, so the consumer refuses to start without
+// one. On shutdown an unfinished event is left uncommitted and is
+// redelivered on the next start.
+func (a *API) StartStatusConsumer(ctx context.Context) {
+	if a.RStatus == nil {
+		return
+	}
+	if a.WStatusDLQ == nil {
+		slog.Error("status consumer not started: no DLQ writer")
+		return
+	}
+	a.bg.Add(1)
+	go func() {
+		defer a.bg.Done()
+		defer a.RStatus.Close()
+		// in-flight events finish applying even when ctx is canceled
+		applyCtx := context.WithoutCancel(ctx)
+		for {
+			m, err := a.RStatus.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Error("status fetch failed", "err", err)
+				continue
+			}
+			observeLag(m.Partition, m.HighWaterMark, m.Offset)
+			// continue the trace the worker put in the headers
+			sctx, span := tracer.Start(otel.GetTextMapPropagator().Extract(recordContext(applyCtx, m), kafkaHeaders{&m.Headers}), "apply status",
+				trace.WithSpanKind(trace.SpanKindConsumer),
+				trace.WithAttributes(attribute.Int("kafka.partition", m.Partition), attribute.Int64("kafka.offset", m.Offset)))
+			done := a.handleStatus(trace.ContextWithSpan(recordContext(ctx, m), span), sctx, m)
+			span.End()
+			if !done {
+				return
+			}
+			if err := a.RStatus.CommitMessages(applyCtx, m); err != nil {
+				// redelivery is harmless: the state machine drops duplicates
+				slog.WarnContext(sctx, "status commit failed", "err", err)
+			}
+		}
+	}()
+}
+
+// recordContext tags ctx with the IDs in a Kafka record's headers.
+func recordContext(ctx context.Context, m kafka.Message) context.Context {
+	h := kafkaHeaders{&m.Headers}
+	ctx = logging.With(ctx, logging.MessageID, h.Get("x-msg-id"))
+	ctx = logging.With(ctx, logging.ClientID, h.Get("x-client-id"))
+	return logging.With(ctx, logging.RequestID, h.Get("x-request-id"))
+}
+
+// handleStatus processes one record until it is done with it. It returns
+// false only when ctx is canceled before that.
+func (a *API) handleStatus(ctx, applyCtx context.Context, m kafka.Message) bool {
+	backoff := 100 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := a.decodeAndApply(applyCtx, m)
+		switch {
+		case err == nil:
+			return true
+		case isRejected(err):
+			slog.InfoContext(applyCtx, "status rejected", "err", err)
+			return true
+		case isPoison(err):
+			return a.deadLetter(ctx, m, err, attempt)
+		}
+		slog.WarnContext(applyCtx, "status apply failed", "attempt", attempt, "err", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+func (a *API) decodeAndApply(ctx context.Context, m kafka.Message) (err error) {
+	start := time.Now()
+	defer func() { observeStatus(start, err) }()
+	var evt StatusEvent
+	if err := json.Unmarshal(m.Value, &evt); err != nil {
+		return fmt.Errorf("%w: %v", errBadEvent, err)
+	}
+	return a.applyStatus(ctx, evt)
+}
+
+// isRejected reports errors for events the state machine refused; those
+// are already recorded and need no retry.
+func isRejected(err error) bool {
+	return errors.Is(err, errUnknownStatus) || errors.Is(err, errIllegalTransition) ||
+		errors.Is(err, errStaleEvent) || errors.Is(err, errDuplicateEvent)
+}
+
+// isPoison reports errors that no amount of retrying will fix.
+func isPoison(err error) bool {
+	if errors.Is(err, errBadEvent) || errors.Is(err, gorm.ErrRecordNotFound) {
+		return true
+	}
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.InvalidArgument, codes.NotFound, codes.FailedPrecondition, codes.PermissionDenied, codes.Unimplemented:
+			return true
+		}
+	}
+	return false
+}
+
+// deadLetter parks m in the dead-letter topic, retrying the write until it
+// succeeds or ctx is canceled.
+func (a *API) deadLetter(ctx context.Context, m kafka.Message, cause error, attempts int) bool {
+	headers := append([]kafka.Header{}, m.Headers...)
+	headers = append(headers,
+		kafka.Header{Key: "x-error", Value: []byte(cause.Error())},
+		kafka.Header{Key: "x-attempts", Value: []byte(strconv.Itoa(attempts))},
+		kafka.Header{Key: "x-source-topic", Value: []byte(m.Topic)},
+		kafka.Header{Key: "x-source-partition", Value: []byte(strconv.Itoa(m.Partition))},
+		kafka.Header{Key: "x-source-offset", Value: []byte(strconv.FormatInt(m.Offset, 10))},
+	)
+	dl := kafka.Message{Key: m.Key, Value: m.Value, Headers: headers}
+	for {
+		err := a.WStatusDLQ.WriteMessages(ctx, dl)
+		if err == nil {
+			slog.WarnContext(ctx, "status parked in DLQ", "partition", m.Partition, "offset", m.Offset, "err", cause)
+			return true
+		}
+		slog.ErrorContext(ctx, "status DLQ write failed", "err", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
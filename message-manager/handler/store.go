@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageStore reads and writes messages; nothing else in the package
+// queries the messages table. It exists for the row locking a status
+// transition needs, which each database does its own way;
+// NewMessageStore picks the implementation for the database.
+type MessageStore interface {
+	// Tx runs fn in a transaction, committed when fn returns nil.
+	Tx(ctx context.Context, fn func(tx *MessageTx) error) error
+	// Transition runs fn in a transaction with message id loaded and
+	// locked against other transitions until it commits. fn saves its
+	// changes with tx.Save.
+	Transition(ctx context.Context, id int, fn func(tx *MessageTx, m *Message) error) (Message, error)
+
+	// Get returns message id, only if it belongs to clientID when that is
+	// set. An ID that is not a number is not found.
+	Get(ctx context.Context, clientID, id string) (Message, error)
+	// Find returns the messages q selects, in q.Order.
+	Find(ctx context.Context, q MessageQuery) ([]Message, error)
+	// EachStored passes the messages q selects to fn in batches, as stored:
+	// hooks are skipped, so sealed rows stay sealed. q.Order, q.Limit and
+	// q.Page are ignored.
+	EachStored(ctx context.Context, q MessageQuery, fn func([]Message) error) error
+	// Touch bumps the updated_at of message id if it is still in status,
+	// and reports whether it was.
+	Touch(ctx context.Context, id int, status string) (bool, error)
+	// ArchivableClients lists up to limit clients with messages Archivable
+	// would return for a cutoff of before.
+	ArchivableClients(ctx context.Context, before time.Time, limit int) ([]string, error)
+
+	// NotUnderKey returns up to limit messages whose KeyID is not keyID,
+	// with only ID, KeyID and WrappedKey loaded.
+	NotUnderKey(ctx context.Context, keyID string, limit int) ([]Message, error)
+	// Rewrap replaces the wrapped data key of message id, unless a save
+	// moved it off fromKey meanwhile.
+	Rewrap(ctx context.Context, id int, fromKey, toKey, wrapped string) error
+	// Seal writes the sealed Body, To and key columns of m over its
+	// plaintext row, unless the row was sealed meanwhile.
+	Seal(ctx context.Context, m *Message) error
+}
+
+// MessageQuery selects messages for MessageStore.Find. Zero fields match
+// every message.
+type MessageQuery struct {
+	ClientID string
+	Status   string
+	Type     string
+	Operator string
+	ParentID int // the messages of one MessageRequest
+	AfterID  int // IDs above it only
+	// Since and Until bound created_at to [Since, Until).
+	Since, Until  time.Time
+	UpdatedBefore time.Time
+	// To matches the whole recipient of plaintext rows; with ToHash set,
+	// sealed rows match their blind index instead.
+	To, ToHash string
+	// Terms are search tokens (see MessageTerm) a message must have all of.
+	Terms     []string
+	Unindexed bool // only messages without search terms
+	Order     MessageOrder
+	Limit     int // 0 means all
+	Page      int // of Limit messages
+}
+
+// MessageOrder is the order MessageStore.Find returns messages in.
+type MessageOrder int
+
+const (
+	NewestFirst  MessageOrder = iota // by created_at, then ID, descending
+	OldestFirst                      // by created_at
+	ByID                             // by ID
+	StalestFirst                     // by updated_at
+)
+
+// MessageTx is a transaction opened by a MessageStore. Messages are read
+// and written through its methods; db is the same transaction, for the
+// other tables that change along with them (stats, search terms, links,
+// events).
+type MessageTx struct {
+	db   *gorm.DB
+	lock func(tx *gorm.DB, ids []int) error
+}
+
+// NewMessageStore returns the MessageStore for db's dialect: PostgreSQL,
+// SQLite, or MySQL for anything else.
+func NewMessageStore(db *gorm.DB) MessageStore {
+	switch db.Dialector.Name() {
+	case "postgres":
+		// NO KEY UPDATE does not block inserts referencing the row
+		return &sqlMessages{db: db, lock: lockForUpdate("NO KEY UPDATE")}
+	case "sqlite":
+		return &sqlMessages{db: db, lock: lockSQLite}
+	default:
+		return &sqlMessages{db: db, lock: lockForUpdate("UPDATE")}
+	}
+}
+
+// sqlMessages is the MessageStore on gorm; the backends differ only in
+// how rows are locked.
+type sqlMessages struct {
+	db   *gorm.DB
+	lock func(tx *gorm.DB, ids []int) error
+}
+
+// lockForUpdate locks rows with SELECT ... FOR strength.
+func lockForUpdate(strength string) func(tx *gorm.DB, ids []int) error {
+	return func(tx *gorm.DB, ids []int) error {
+		var locked []int
+		return tx.Model(&Message{}).Clauses(clause.Locking{Strength: strength}).
+			Where("id IN ?", ids).Order("id").Pluck("id", &locked).Error
+	}
+}
+
+// lockSQLite takes the database write lock, SQLite's only lock that keeps
+// other writers out, with a write that changes nothing. A plain read
+// would let two transactions load the same row and the later commit fail
+// instead of wait.
+func lockSQLite(tx *gorm.DB, ids []int) error {
+	return tx.Session(&gorm.Session{SkipHooks: true}).Model(&Message{}).
+		Where("id IN ?", ids).UpdateColumn("id", gorm.Expr("id")).Error
+}
+
+func (s *sqlMessages) Tx(ctx context.Context, fn func(tx *MessageTx) error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&MessageTx{db: tx, lock: s.lock})
+	})
+}
+
+func (s *sqlMessages) Transition(ctx context.Context, id int, fn func(tx *MessageTx, m *Message) error) (Message, error) {
+	var m Message
+	err := s.Tx(ctx, func(tx *MessageTx) error {
+		if err := tx.Lock([]int{id}); err != nil {
+			return err
+		}
+		var err error
+		if m, err = tx.Get(id); err != nil {
+			return err
+		}
+		return fn(tx, &m)
+	})
+	return m, err
+}
+
+func (s *sqlMessages) Get(ctx context.Context, clientID, id string) (Message, error) {
+	var m Message
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return m, gorm.ErrRecordNotFound
+	}
+	q := s.db.WithContext(ctx).Where("id = ?", n)
+	if clientID != "" {
+		q = q.Where("client_id = ?", clientID)
+	}
+	err = q.First(&m).Error
+	return m, err
+}
+
+func (s *sqlMessages) Find(ctx context.Context, q MessageQuery) ([]Message, error) {
+	db := s.where(s.db.WithContext(ctx), q)
+	switch q.Order {
+	case NewestFirst:
+		db = db.Order("created_at DESC").Order("id DESC")
+	case OldestFirst:
+		db = db.Order("created_at ASC").Order("id ASC")
+	case ByID:
+		db = db.Order("id ASC")
+	case StalestFirst:
+		db = db.Order("updated_at ASC").Order("id ASC")
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit).Offset(q.Page * q.Limit)
+	}
+	var msgs []Message
+	err := db.Find(&msgs).Error
+	return msgs, err
+}
+
+func (s *sqlMessages) EachStored(ctx context.Context, q MessageQuery, fn func([]Message) error) error {
+	var batch []Message
+	return s.where(s.db.WithContext(ctx).Session(&gorm.Session{SkipHooks: true}), q).
+		FindInBatches(&batch, 1000, func(*gorm.DB, int) error { return fn(batch) }).Error
+}
+
+// where narrows db to the messages q selects.
+func (s *sqlMessages) where(db *gorm.DB, q MessageQuery) *gorm.DB {
+	db = db.Model(&Message{})
+	for _, c := range []struct{ col, v string }{{"client_id", q.ClientID}, {"status", q.Status}, {"type", q.Type}, {"operator", q.Operator}} {
+		if c.v != "" {
+			db = db.Where(c.col+" = ?", c.v)
+		}
+	}
+	if q.ParentID != 0 {
+		db = db.Where("parent_id = ?", q.ParentID)
+	}
+	if q.AfterID != 0 {
+		db = db.Where("id > ?", q.AfterID)
+	}
+	if !q.Since.IsZero() {
+		db = db.Where("created_at >= ?", q.Since)
+	}
+	if !q.Until.IsZero() {
+		db = db.Where("created_at < ?", q.Until)
+	}
+	if !q.UpdatedBefore.IsZero() {
+		db = db.Where("updated_at < ?", q.UpdatedBefore)
+	}
+	if q.To != "" || q.ToHash != "" {
+		to := clause.Eq{Column: clause.Column{Name: "to"}, Value: q.To}
+		if q.ToHash != "" {
+			// rows from before encryption have no blind index
+			db = db.Where(s.db.Where("to_hash = ?", q.ToHash).
+				Or(clause.And(clause.Eq{Column: "key_id", Value: ""}, to)))
+		} else {
+			db = db.Where(to)
+		}
+	}
+	if len(q.Terms) > 0 {
+		sub := s.db.Model(&MessageTerm{}).Select("message_id").Where("token IN ?", q.Terms)
+		if q.ClientID != "" {
+			sub = sub.Where("client_id = ?", q.ClientID)
+		}
+		sub = sub.Group("message_id").Having("COUNT(*) = ?", len(q.Terms))
+		db = db.Where("id IN (?)", sub)
+	}
+	if q.Unindexed {
+		db = db.Where("NOT EXISTS (SELECT 1 FROM message_terms t WHERE t.message_id = messages.id)")
+	}
+	return db
+}
+
+func (s *sqlMessages) Touch(ctx context.Context, id int, status string) (bool, error) {
+	res := s.db.WithContext(ctx).Model(&Message{}).Where("id = ? AND status = ?", id, status).Update("updated_at", time.Now())
+	return res.RowsAffected > 0, res.Error
+}
+
+func (s *sqlMessages) ArchivableClients(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	var clients []string
+	err := archivable(s.db.WithContext(ctx).Model(&Message{}), before).
+		Distinct("client_id").Limit(limit).Pluck("client_id", &clients).Error
+	return clients, err
+}
+
+// archivable restricts q to finalized messages last touched before cutoff
+// whose money is settled (or that never had a reservation).
+func archivable(q *gorm.DB, cutoff time.Time) *gorm.DB {
+	return q.Where("status IN ? AND updated_at < ?", finalStatuses, cutoff).
+		Where("settled_at IS NOT NULL OR reservation_id = '' OR reservation_id IS NULL")
+}
+
+func (s *sqlMessages) NotUnderKey(ctx context.Context, keyID string, limit int) ([]Message, error) {
+	var msgs []Message
+	err := s.db.WithContext(ctx).Session(&gorm.Session{SkipHooks: true}).Model(&Message{}).
+		Select("id, key_id, wrapped_key").Where("key_id <> ?", keyID).Limit(limit).Find(&msgs).Error
+	return msgs, err
+}
+
+func (s *sqlMessages) Rewrap(ctx context.Context, id int, fromKey, toKey, wrapped string) error {
+	return s.db.WithContext(ctx).Model(&Message{}).Where("id = ? AND key_id = ?", id, fromKey).
+		UpdateColumns(map[string]any{"key_id": toKey, "wrapped_key": wrapped}).Error
+}
+
+func (s *sqlMessages) Seal(ctx context.Context, m *Message) error {
+	return s.db.WithContext(ctx).Model(&Message{}).Where("id = ? AND key_id = ?", m.ID, "").
+		UpdateColumns(map[string]any{"body": m.Body, "to": m.To, "to_hash": m.ToHash, "key_id": m.KeyID, "wrapped_key": m.WrappedKey}).Error
+}
+
+// Create inserts m, assigning its ID.
+func (tx *MessageTx) Create(m *Message) error {
+	return tx.db.Create(m).Error
+}
+
+// Get returns message id without locking it.
+func (tx *MessageTx) Get(id int) (Message, error) {
+	var m Message
+	err := tx.db.First(&m, "id = ?", id).Error
+	return m, err
+}
+
+// Save writes m back.
+func (tx *MessageTx) Save(m *Message) error {
+	return tx.db.Save(m).Error
+}
+
+// Lock locks messages ids until the transaction commits, as Transition
+// does for one.
+func (tx *MessageTx) Lock(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return tx.lock(tx.db, ids)
+}
+
+// Move locks ids and moves those still in status from to status to,
+// last updated at. It returns the IDs it moved.
+func (tx *MessageTx) Move(ids []int, from, to string, at time.Time) ([]int, error) {
+	if err := tx.Lock(ids); err != nil {
+		return nil, err
+	}
+	var moved []int
+	if err := tx.db.Model(&Message{}).Where("id IN ? AND status = ?", ids, from).Pluck("id", &moved).Error; err != nil {
+		return nil, err
+	}
+	if len(moved) == 0 {
+		return nil, nil
+	}
+	err := tx.db.Model(&Message{}).Where("id IN ?", moved).
+		UpdateColumns(map[string]any{"status": to, "updated_at": at}).Error
+	return moved, err
+}
+
+// MarkSettled sets the settled_at of message id to at unless it is set
+// already, and reports whether it was not.
+func (tx *MessageTx) MarkSettled(id int, at time.Time) (bool, error) {
+	res := tx.db.Model(&Message{}).Where("id = ? AND settled_at IS NULL", id).Update("settled_at", at)
+	return res.RowsAffected > 0, res.Error
+}
+
+// Archivable locks and returns, as stored, up to limit of clientID's
+// finalized and settled messages last changed before cutoff, by ID.
+func (tx *MessageTx) Archivable(clientID string, cutoff time.Time, limit int) ([]Message, error) {
+	var msgs []Message
+	err := archivable(tx.db.Session(&gorm.Session{SkipHooks: true}).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("client_id = ?", clientID), cutoff).Order("id").Limit(limit).Find(&msgs).Error
+	return msgs, err
+}
+
+// Delete deletes messages ids.
+func (tx *MessageTx) Delete(ids []int) error {
+	return tx.db.Where("id IN ?", ids).Delete(&Message{}).Error
+}
+
+// Restore inserts msgs as stored, keeping their IDs and skipping those
+// that exist. It returns how many it inserted.
+func (tx *MessageTx) Restore(msgs []Message) (int, error) {
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	// counted up front: not every driver reports the rows an INSERT ... ON
+	// CONFLICT DO NOTHING skipped
+	want := make([]int, len(msgs))
+	for i, m := range msgs {
+		want[i] = m.ID
+	}
+	var have []int
+	if err := tx.db.Model(&Message{}).Where("id IN ?", want).Pluck("id", &have).Error; err != nil {
+		return 0, err
+	}
+	exists := make(map[int]bool, len(have))
+	for _, id := range have {
+		exists[id] = true
+	}
+	missing := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if !exists[m.ID] {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	err := tx.db.Session(&gorm.Session{SkipHooks: true}).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(missing, 200).Error
+	return len(missing), err
+}
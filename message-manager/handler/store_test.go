@@ -0,0 +1,47 @@
+package handler_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	initx "message-manager/init"
+	"message-manager/storetest"
+
+	"gorm.io/gorm/logger"
+)
+
+// TestMessageStore runs the conformance suite against SQLite and, when
+// their DSNs are set, against MySQL and PostgreSQL.
+func TestMessageStore(t *testing.T) {
+	backends := []struct{ name, env string }{
+		{"mysql", "MM_TEST_MYSQL_DSN"},
+		{"postgres", "MM_TEST_POSTGRES_DSN"},
+	}
+	t.Run("sqlite", func(t *testing.T) { runStoreSuite(t, "sqlite://:memory:") })
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			dsn := os.Getenv(b.env)
+			if dsn == "" {
+				t.Skip(b.env + " not set")
+			}
+			runStoreSuite(t, dsn)
+		})
+	}
+}
+
+func runStoreSuite(t *testing.T, dsn string) {
+	db, err := initx.OpenDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Logger = logger.Default.LogMode(logger.Silent) // the checks provoke errors on purpose
+	if sqlDB, err := db.DB(); err == nil {
+		t.Cleanup(func() { sqlDB.Close() })
+	}
+	for _, r := range storetest.Run(context.Background(), db) {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Name, r.Err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+var tracer = otel.Tracer("message-manager")
+
+// kafkaHeaders carries trace context in Kafka record headers.
+type kafkaHeaders struct{ h *[]kafka.Header }
+
+func (c kafkaHeaders) Get(key string) string {
+	for _, h := range *c.h {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c kafkaHeaders) Set(key, value string) {
+	for i, h := range *c.h {
+		if h.Key == key {
+			(*c.h)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.h = append(*c.h, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c kafkaHeaders) Keys() []string {
+	keys := make([]string, 0, len(*c.h))
+	for _, h := range *c.h {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// traceParent returns ctx's span context in W3C traceparent form, to be
+// stored with a message so a later publish joins the request's trace.
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+func withTraceParent(ctx context.Context, tp string) context.Context {
+	if tp == "" {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier{"traceparent": tp})
+}
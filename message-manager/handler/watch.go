@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatusChange is a committed status change, fanned out to watchers.
+type StatusChange struct {
+	MessageID string
+	ClientID  string
+	Status    string
+	Operator  string
+	At        time.Time
+}
+
+// statusHub fans status changes out to in-process subscribers. It only
+// sees changes made by this instance; with several replicas a watcher
+// gets the events of the status partitions its replica consumes.
+type statusHub struct {
+	mu   sync.Mutex
+	subs map[chan StatusChange]string // -> client ID
+}
+
+// Subscribe returns a channel of the client's status changes and a
+// function that unsubscribes. A subscriber that falls behind loses
+// updates rather than slowing the status consumer down.
+func (a *API) Subscribe(clientID string) (<-chan StatusChange, func()) {
+	h := &a.hub
+	ch := make(chan StatusChange, 64)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = map[chan StatusChange]string{}
+	}
+	h.subs[ch] = clientID
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (a *API) notify(m Message) {
+	sc := StatusChange{MessageID: strconv.Itoa(m.ID), ClientID: m.ClientID, Status: m.Status, Operator: m.Operator, At: m.UpdatedAt}
+	h := &a.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, clientID := range h.subs {
+		if clientID != m.ClientID {
+			continue
+		}
+		select {
+		case ch <- sc:
+		default:
+		}
+	}
+}
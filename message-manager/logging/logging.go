@@ -0,0 +1,89 @@
+// Package logging sets up the service's slog logger and carries
+// correlation fields (request, client and message IDs) in contexts, so
+// every line logged with a context names what it belongs to. The trace
+// and span IDs of the context's span are added as well.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	RequestID = "request_id"
+	ClientID  = "client_id"
+	MessageID = "message_id"
+)
+
+// Setup installs a JSON logger at LOG_LEVEL (debug, info, warn or error;
+// info when unset) as the slog and log package default.
+func Setup(service string) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(os.Getenv("LOG_LEVEL")))); err != nil {
+		level = slog.LevelInfo
+	}
+	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(ctxHandler{h}).With("service", service))
+}
+
+type fieldsKey struct{}
+
+// With returns a copy of ctx whose log lines carry key=value. An empty
+// value is ignored; setting a key again replaces it.
+func With(ctx context.Context, key, value string) context.Context {
+	if value == "" {
+		return ctx
+	}
+	old, _ := ctx.Value(fieldsKey{}).([]slog.Attr)
+	attrs := make([]slog.Attr, 0, len(old)+1)
+	for _, a := range old {
+		if a.Key != key {
+			attrs = append(attrs, a)
+		}
+	}
+	return context.WithValue(ctx, fieldsKey{}, append(attrs, slog.String(key, value)))
+}
+
+// Field returns the value of a correlation field set with With.
+func Field(ctx context.Context, key string) string {
+	attrs, _ := ctx.Value(fieldsKey{}).([]slog.Attr)
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Value.String()
+		}
+	}
+	return ""
+}
+
+// NewRequestID returns a random ID for requests that arrive without one.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type ctxHandler struct{ slog.Handler }
+
+func (h ctxHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(fieldsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h ctxHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return ctxHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h ctxHandler) WithGroup(name string) slog.Handler {
+	return ctxHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Gin tags the request context with the request ID (X-Request-ID, or a
+// new one echoed back in the response), the X-Client-ID and, on
+// /messages/:id routes, the message ID, and logs one line per request.
+// It must run after the tracing middleware so the line carries the trace.
+func Gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		rid := c.GetHeader("X-Request-ID")
+		if rid == "" {
+			rid = NewRequestID()
+		}
+		c.Header("X-Request-ID", rid)
+		ctx := With(c.Request.Context(), RequestID, rid)
+		ctx = With(ctx, ClientID, c.GetHeader("X-Client-ID"))
+		if strings.HasPrefix(c.FullPath(), "/messages/:id") {
+			ctx = With(ctx, MessageID, c.Param("id"))
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		path := c.FullPath()
+		if path == "" {
+			path = c.Request.URL.Path
+		}
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(c.Request.Context(), level, "http request",
+			"method", c.Request.Method, "path", path, "status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+type clientIDGetter interface{ GetClientId() string }
+
+// serverContext tags an incoming call's context from its metadata, falling
+// back to the request's client_id field for the client ID.
+func serverContext(ctx context.Context, req any) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	rid := first(md, "x-request-id")
+	if rid == "" {
+		rid = NewRequestID()
+	}
+	ctx = With(ctx, RequestID, rid)
+	cid := first(md, "x-client-id")
+	if g, ok := req.(clientIDGetter); ok && cid == "" {
+		cid = g.GetClientId()
+	}
+	return With(ctx, ClientID, cid)
+}
+
+func first(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "grpc request", "method", method, "code", code.String(), "duration_ms", time.Since(start).Milliseconds())
+}
+
+// UnaryServer tags and logs unary calls like Gin does HTTP requests.
+func UnaryServer(ctx context.Context, req any, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx = serverContext(ctx, req)
+	resp, err := next(ctx, req)
+	logCall(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+type taggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s taggedStream) Context() context.Context { return s.ctx }
+
+// StreamServer tags and logs streaming calls once they end.
+func StreamServer(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+	start := time.Now()
+	ctx := serverContext(ss.Context(), nil)
+	err := next(srv, taggedStream{ServerStream: ss, ctx: ctx})
+	logCall(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// UnaryClient passes the request ID on to the called service.
+func UnaryClient(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if rid := Field(ctx, RequestID); rid != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", rid)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
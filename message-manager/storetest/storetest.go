@@ -0,0 +1,726 @@
+// Package storetest is the conformance suite for handler.MessageStore: it
+// checks a store does what the handlers count on, so every backend can be
+// held to the same contract. go test runs it against SQLite, and against
+// MySQL and PostgreSQL when MM_TEST_MYSQL_DSN and MM_TEST_POSTGRES_DSN are
+// set; cmd/storecheck runs it against any database URL.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"message-manager/handler"
+
+	"gorm.io/gorm"
+)
+
+// Result is the outcome of one check; Err is nil when it passed.
+type Result struct {
+	Name string
+	Err  error
+}
+
+// Concurrency is how many transitions the locking checks run at once.
+var Concurrency = 16
+
+var checks = []struct {
+	name string
+	fn   func(ctx context.Context, s *suite) error
+}{
+	{"create and get", checkCreateGet},
+	{"get scoped to client", checkGetScoped},
+	{"list order and paging", checkListPaging},
+	{"list filters", checkListFilters},
+	{"transition saves", checkTransitionSaves},
+	{"transition rolls back", checkTransitionRollback},
+	{"transition missing message", checkTransitionMissing},
+	{"concurrent transitions", checkConcurrentTransitions},
+	{"lock several", checkLockSeveral},
+	{"find filters and orders", checkFindQuery},
+	{"find by search terms", checkFindTerms},
+	{"each stored", checkEachStored},
+	{"move", checkMove},
+	{"mark settled once", checkMarkSettled},
+	{"touch", checkTouch},
+	{"archive and restore", checkArchiveRestore},
+	{"rewrap and seal", checkRekey},
+}
+
+// Run migrates the messages and search terms tables in db and runs every check against the
+// MessageStore handler.NewMessageStore picks for it. The messages it
+// creates belong to client IDs of their own, so db need not be empty.
+func Run(ctx context.Context, db *gorm.DB) []Result {
+	if err := db.AutoMigrate(&handler.Message{}, &handler.MessageTerm{}); err != nil {
+		return []Result{{Name: "migrate", Err: err}}
+	}
+	s := &suite{db: db, store: handler.NewMessageStore(db), run: time.Now().UnixNano()}
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		results = append(results, Result{Name: c.name, Err: c.fn(ctx, s)})
+	}
+	return results
+}
+
+type suite struct {
+	db    *gorm.DB
+	store handler.MessageStore
+	run   int64
+	n     int
+}
+
+// client returns a client ID no other check or run uses.
+func (s *suite) client() string {
+	s.n++
+	return fmt.Sprintf("storetest-%d-%d", s.run, s.n)
+}
+
+// create stores a CREATED message for clientID created at at.
+func (s *suite) create(ctx context.Context, clientID, typ string, at time.Time) (handler.Message, error) {
+	m := handler.Message{ClientID: clientID, From: "sender", To: "+989120000000", Body: "storetest", Type: typ, PriceMinor: 10, Status: "CREATED", CreatedAt: at, UpdatedAt: at}
+	err := s.store.Tx(ctx, func(tx *handler.MessageTx) error {
+		return tx.Create(&m)
+	})
+	return m, err
+}
+
+func id(m handler.Message) string { return fmt.Sprint(m.ID) }
+
+func checkCreateGet(ctx context.Context, s *suite) error {
+	client := s.client()
+	at := time.Now().Truncate(time.Second)
+	m, err := s.create(ctx, client, "NORMAL", at)
+	if err != nil {
+		return err
+	}
+	if m.ID == 0 {
+		return errors.New("create did not assign an ID")
+	}
+	got, err := s.store.Get(ctx, client, id(m))
+	if err != nil {
+		return err
+	}
+	if got.ID != m.ID || got.ClientID != client || got.From != m.From || got.To != m.To || got.Body != m.Body ||
+		got.Type != m.Type || got.PriceMinor != m.PriceMinor || got.Status != m.Status {
+		return fmt.Errorf("got %+v, stored %+v", got, m)
+	}
+	if !got.CreatedAt.Equal(at) {
+		return fmt.Errorf("created_at %s, stored %s", got.CreatedAt, at)
+	}
+	second, err := s.create(ctx, client, "NORMAL", at)
+	if err != nil {
+		return err
+	}
+	if second.ID == m.ID {
+		return fmt.Errorf("two messages got ID %d", m.ID)
+	}
+	return nil
+}
+
+func checkGetScoped(ctx context.Context, s *suite) error {
+	client := s.client()
+	m, err := s.create(ctx, client, "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Get(ctx, s.client(), id(m)); !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("another client's get: %v, want not found", err)
+	}
+	if got, err := s.store.Get(ctx, "", id(m)); err != nil || got.ID != m.ID {
+		return fmt.Errorf("unscoped get: %d, %v", got.ID, err)
+	}
+	for _, bad := range []string{"", "abc", "1 OR 1=1"} {
+		if _, err := s.store.Get(ctx, client, bad); !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("get %q: %v, want not found", bad, err)
+		}
+	}
+	return nil
+}
+
+func checkListPaging(ctx context.Context, s *suite) error {
+	client := s.client()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var ids []int
+	for i := 0; i < 5; i++ {
+		m, err := s.create(ctx, client, "NORMAL", base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			return err
+		}
+		ids = append([]int{m.ID}, ids...) // newest first
+	}
+	var got []int
+	for page := 0; page < 3; page++ {
+		msgs, err := s.store.Find(ctx, handler.MessageQuery{ClientID: client, Limit: 2, Page: page})
+		if err != nil {
+			return err
+		}
+		if want := min(2, 5-2*page); len(msgs) != want {
+			return fmt.Errorf("page %d has %d messages, want %d", page, len(msgs), want)
+		}
+		for _, m := range msgs {
+			got = append(got, m.ID)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(ids) {
+		return fmt.Errorf("listed %v, want %v", got, ids)
+	}
+	if msgs, err := s.store.Find(ctx, handler.MessageQuery{ClientID: s.client(), Limit: 10}); err != nil || len(msgs) != 0 {
+		return fmt.Errorf("another client listed %d messages, %v", len(msgs), err)
+	}
+	return nil
+}
+
+func checkListFilters(ctx context.Context, s *suite) error {
+	client := s.client()
+	now := time.Now()
+	for _, typ := range []string{"NORMAL", "NORMAL", "OTP"} {
+		if _, err := s.create(ctx, client, typ, now); err != nil {
+			return err
+		}
+	}
+	msgs, err := s.store.Find(ctx, handler.MessageQuery{ClientID: client})
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Transition(ctx, msgs[0].ID, func(tx *handler.MessageTx, m *handler.Message) error {
+		m.Status = "QUEUED"
+		return tx.Save(m)
+	}); err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		f    handler.MessageQuery
+		want int
+	}{
+		{handler.MessageQuery{Type: "NORMAL"}, 2},
+		{handler.MessageQuery{Type: "OTP"}, 1},
+		{handler.MessageQuery{Type: "BULK"}, 0},
+		{handler.MessageQuery{Status: "CREATED"}, 2},
+		{handler.MessageQuery{Status: "QUEUED"}, 1},
+		{handler.MessageQuery{Type: msgs[0].Type, Status: "QUEUED"}, 1},
+	} {
+		c.f.ClientID = client
+		got, err := s.store.Find(ctx, c.f)
+		if err != nil {
+			return err
+		}
+		if len(got) != c.want {
+			return fmt.Errorf("type %q status %q listed %d, want %d", c.f.Type, c.f.Status, len(got), c.want)
+		}
+		for _, m := range got {
+			if (c.f.Type != "" && m.Type != c.f.Type) || (c.f.Status != "" && m.Status != c.f.Status) {
+				return fmt.Errorf("type %q status %q listed a %s %s message", c.f.Type, c.f.Status, m.Type, m.Status)
+			}
+		}
+	}
+	return nil
+}
+
+func checkTransitionSaves(ctx context.Context, s *suite) error {
+	client := s.client()
+	m, err := s.create(ctx, client, "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	at := time.Now().Truncate(time.Second)
+	got, err := s.store.Transition(ctx, m.ID, func(tx *handler.MessageTx, m *handler.Message) error {
+		if m.Status != "CREATED" {
+			return fmt.Errorf("transition loaded status %s, want CREATED", m.Status)
+		}
+		m.Status, m.Operator, m.StatusAt = "ACCEPTED", "mock", &at
+		return tx.Save(m)
+	})
+	if err != nil {
+		return err
+	}
+	if got.Status != "ACCEPTED" {
+		return fmt.Errorf("transition returned status %s", got.Status)
+	}
+	stored, err := s.store.Get(ctx, client, id(m))
+	if err != nil {
+		return err
+	}
+	if stored.Status != "ACCEPTED" || stored.Operator != "mock" || stored.StatusAt == nil || !stored.StatusAt.Equal(at) {
+		return fmt.Errorf("stored %s by %q at %v after the transition", stored.Status, stored.Operator, stored.StatusAt)
+	}
+	return nil
+}
+
+func checkTransitionRollback(ctx context.Context, s *suite) error {
+	client := s.client()
+	m, err := s.create(ctx, client, "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	refused := errors.New("refused")
+	_, err = s.store.Transition(ctx, m.ID, func(tx *handler.MessageTx, m *handler.Message) error {
+		m.Status = "FAILED"
+		if err := tx.Save(m); err != nil {
+			return err
+		}
+		return refused
+	})
+	if !errors.Is(err, refused) {
+		return fmt.Errorf("transition returned %v, want fn's error", err)
+	}
+	stored, err := s.store.Get(ctx, client, id(m))
+	if err != nil {
+		return err
+	}
+	if stored.Status != "CREATED" {
+		return fmt.Errorf("status %s after a failed transition, want CREATED", stored.Status)
+	}
+	return nil
+}
+
+func checkTransitionMissing(ctx context.Context, s *suite) error {
+	called := false
+	_, err := s.store.Transition(ctx, -1, func(*handler.MessageTx, *handler.Message) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("transition of a missing message: %v, want not found", err)
+	}
+	if called {
+		return errors.New("fn called for a missing message")
+	}
+	return nil
+}
+
+// checkConcurrentTransitions has transitions read, change and save the
+// same row at once; without the lock some of the changes are lost.
+func checkConcurrentTransitions(ctx context.Context, s *suite) error {
+	client := s.client()
+	m, err := s.create(ctx, client, "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.store.Transition(ctx, m.ID, func(tx *handler.MessageTx, m *handler.Message) error {
+				price := m.PriceMinor
+				time.Sleep(time.Millisecond) // widen the window for a lost update
+				m.PriceMinor = price + 1
+				return tx.Save(m)
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	stored, err := s.store.Get(ctx, client, id(m))
+	if err != nil {
+		return err
+	}
+	if want := m.PriceMinor + int64(Concurrency); stored.PriceMinor != want {
+		return fmt.Errorf("price %d after %d transitions, want %d: updates were lost", stored.PriceMinor, Concurrency, want)
+	}
+	return nil
+}
+
+// checkLockSeveral moves a unit between two rows under Lock while
+// transitions change one of them; the sum stays put only if Lock keeps
+// the transitions out.
+func checkLockSeveral(ctx context.Context, s *suite) error {
+	client := s.client()
+	a, err := s.create(ctx, client, "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	b, err := s.create(ctx, client, "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, 2*Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- s.store.Tx(ctx, func(tx *handler.MessageTx) error {
+				if err := tx.Lock([]int{b.ID, a.ID}); err != nil {
+					return err
+				}
+				ra, err := tx.Get(a.ID)
+				if err != nil {
+					return err
+				}
+				rb, err := tx.Get(b.ID)
+				if err != nil {
+					return err
+				}
+				time.Sleep(time.Millisecond)
+				ra.PriceMinor--
+				rb.PriceMinor++
+				if err := tx.Save(&ra); err != nil {
+					return err
+				}
+				return tx.Save(&rb)
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.store.Transition(ctx, a.ID, func(tx *handler.MessageTx, m *handler.Message) error {
+				price := m.PriceMinor
+				time.Sleep(time.Millisecond)
+				m.PriceMinor = price + 2
+				return tx.Save(m)
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	var sum int64
+	if err := s.db.Model(&handler.Message{}).Where("id IN ?", []int{a.ID, b.ID}).Select("SUM(price_minor)").Scan(&sum).Error; err != nil {
+		return err
+	}
+	if want := a.PriceMinor + b.PriceMinor + 2*int64(Concurrency); sum != want {
+		return fmt.Errorf("prices sum to %d, want %d: updates were lost", sum, want)
+	}
+	return nil
+}
+
+// ids returns the IDs of msgs, in order.
+func ids(msgs []handler.Message) []int {
+	out := make([]int, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.ID
+	}
+	return out
+}
+
+// createThree stores three messages for a new client, a minute apart.
+func (s *suite) createThree(ctx context.Context) (string, time.Time, []handler.Message, error) {
+	client := s.client()
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var msgs []handler.Message
+	for i := 0; i < 3; i++ {
+		m, err := s.create(ctx, client, "NORMAL", base.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			return "", base, nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return client, base, msgs, nil
+}
+
+func checkFindQuery(ctx context.Context, s *suite) error {
+	client, base, msgs, err := s.createThree(ctx)
+	if err != nil {
+		return err
+	}
+	parent := int(s.run % 1000000)
+	if _, err := s.store.Transition(ctx, msgs[1].ID, func(tx *handler.MessageTx, m *handler.Message) error {
+		m.ParentID = &parent
+		m.Operator = "mock"
+		return tx.Save(m)
+	}); err != nil {
+		return err
+	}
+	all := ids(msgs)
+	for _, c := range []struct {
+		name string
+		q    handler.MessageQuery
+		want []int
+	}{
+		{"by ID", handler.MessageQuery{Order: handler.ByID}, all},
+		{"oldest first", handler.MessageQuery{Order: handler.OldestFirst}, all},
+		{"newest first", handler.MessageQuery{Order: handler.NewestFirst}, []int{all[2], all[1], all[0]}},
+		{"after ID", handler.MessageQuery{AfterID: all[0], Order: handler.ByID}, all[1:]},
+		{"created range", handler.MessageQuery{Since: base.Add(time.Minute), Until: base.Add(2 * time.Minute)}, all[1:2]},
+		{"parent", handler.MessageQuery{ParentID: parent}, all[1:2]},
+		{"operator", handler.MessageQuery{Operator: "mock"}, all[1:2]},
+		{"updated before", handler.MessageQuery{UpdatedBefore: base.Add(90 * time.Second), Order: handler.StalestFirst}, all[:1]},
+		{"recipient", handler.MessageQuery{To: "+989120000000", Order: handler.ByID}, all},
+		{"other recipient", handler.MessageQuery{To: "+989129999999"}, nil},
+		{"limit", handler.MessageQuery{Order: handler.ByID, Limit: 2, Page: 1}, all[2:]},
+	} {
+		c.q.ClientID = client
+		got, err := s.store.Find(ctx, c.q)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(c.want) && !(len(got) == 0 && len(c.want) == 0) {
+			return fmt.Errorf("%s found %v, want %v", c.name, ids(got), c.want)
+		}
+	}
+	return nil
+}
+
+func checkFindTerms(ctx context.Context, s *suite) error {
+	client, _, msgs, err := s.createThree(ctx)
+	if err != nil {
+		return err
+	}
+	terms := []handler.MessageTerm{
+		{MessageID: msgs[0].ID, ClientID: client, Token: "a"},
+		{MessageID: msgs[0].ID, ClientID: client, Token: "b"},
+		{MessageID: msgs[1].ID, ClientID: client, Token: "a"},
+	}
+	if err := s.db.Create(&terms).Error; err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		q    handler.MessageQuery
+		want []int
+	}{
+		{handler.MessageQuery{Terms: []string{"a", "b"}}, ids(msgs[:1])},
+		{handler.MessageQuery{Terms: []string{"a"}}, ids(msgs[:2])},
+		{handler.MessageQuery{Terms: []string{"c"}}, nil},
+		{handler.MessageQuery{Unindexed: true}, ids(msgs[2:])},
+	} {
+		c.q.ClientID, c.q.Order = client, handler.ByID
+		got, err := s.store.Find(ctx, c.q)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(c.want) && !(len(got) == 0 && len(c.want) == 0) {
+			return fmt.Errorf("terms %v unindexed %v found %v, want %v", c.q.Terms, c.q.Unindexed, ids(got), c.want)
+		}
+	}
+	return nil
+}
+
+func checkEachStored(ctx context.Context, s *suite) error {
+	client, base, msgs, err := s.createThree(ctx)
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		q    handler.MessageQuery
+		want int
+	}{
+		{handler.MessageQuery{ClientID: client}, len(msgs)},
+		{handler.MessageQuery{ClientID: client, Since: base.Add(time.Minute)}, 2},
+		{handler.MessageQuery{ClientID: client, Status: "QUEUED"}, 0},
+	} {
+		n := 0
+		if err := s.store.EachStored(ctx, c.q, func(batch []handler.Message) error {
+			n += len(batch)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if n != c.want {
+			return fmt.Errorf("since %s status %q passed %d messages, want %d", c.q.Since, c.q.Status, n, c.want)
+		}
+	}
+	return nil
+}
+
+func checkMove(ctx context.Context, s *suite) error {
+	client, _, msgs, err := s.createThree(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := s.store.Transition(ctx, msgs[0].ID, func(tx *handler.MessageTx, m *handler.Message) error {
+		m.Status = "ACCEPTED"
+		return tx.Save(m)
+	}); err != nil {
+		return err
+	}
+	at := time.Now().Truncate(time.Second)
+	var moved []int
+	if err := s.store.Tx(ctx, func(tx *handler.MessageTx) error {
+		moved, err = tx.Move(ids(msgs), "CREATED", "QUEUED", at)
+		return err
+	}); err != nil {
+		return err
+	}
+	if fmt.Sprint(moved) != fmt.Sprint(ids(msgs[1:])) {
+		return fmt.Errorf("moved %v, want %v", moved, ids(msgs[1:]))
+	}
+	got, err := s.store.Find(ctx, handler.MessageQuery{ClientID: client, Order: handler.ByID})
+	if err != nil {
+		return err
+	}
+	for i, m := range got {
+		want := "QUEUED"
+		if i == 0 {
+			want = "ACCEPTED"
+		}
+		if m.Status != want {
+			return fmt.Errorf("message %d is %s after the move, want %s", m.ID, m.Status, want)
+		}
+		if i > 0 && !m.UpdatedAt.Equal(at) {
+			return fmt.Errorf("message %d updated at %s, want %s", m.ID, m.UpdatedAt, at)
+		}
+	}
+	return nil
+}
+
+func checkMarkSettled(ctx context.Context, s *suite) error {
+	m, err := s.create(ctx, s.client(), "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	for i, want := range []bool{true, false} {
+		var first bool
+		if err := s.store.Tx(ctx, func(tx *handler.MessageTx) error {
+			first, err = tx.MarkSettled(m.ID, time.Now())
+			return err
+		}); err != nil {
+			return err
+		}
+		if first != want {
+			return fmt.Errorf("mark settled #%d reported %v, want %v", i+1, first, want)
+		}
+	}
+	stored, err := s.store.Get(ctx, "", id(m))
+	if err != nil {
+		return err
+	}
+	if stored.SettledAt == nil {
+		return errors.New("settled_at not set")
+	}
+	return nil
+}
+
+func checkTouch(ctx context.Context, s *suite) error {
+	at := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m, err := s.create(ctx, s.client(), "NORMAL", at)
+	if err != nil {
+		return err
+	}
+	if ok, err := s.store.Touch(ctx, m.ID, "QUEUED"); err != nil || ok {
+		return fmt.Errorf("touch in the wrong status: %v, %v", ok, err)
+	}
+	if ok, err := s.store.Touch(ctx, m.ID, "CREATED"); err != nil || !ok {
+		return fmt.Errorf("touch: %v, %v", ok, err)
+	}
+	stored, err := s.store.Get(ctx, "", id(m))
+	if err != nil {
+		return err
+	}
+	if !stored.UpdatedAt.After(at) {
+		return fmt.Errorf("updated_at %s after the touch, want after %s", stored.UpdatedAt, at)
+	}
+	return nil
+}
+
+func checkArchiveRestore(ctx context.Context, s *suite) error {
+	client, _, msgs, err := s.createThree(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if _, err := s.store.Transition(ctx, msgs[0].ID, func(tx *handler.MessageTx, m *handler.Message) error {
+		m.Status, m.SettledAt = "DELIVERED", &now
+		return tx.Save(m)
+	}); err != nil {
+		return err
+	}
+	cutoff := now.Add(time.Hour)
+	clients, err := s.store.ArchivableClients(ctx, cutoff, 1<<20)
+	if err != nil {
+		return err
+	}
+	listed := false
+	for _, c := range clients {
+		listed = listed || c == client
+	}
+	if !listed {
+		return errors.New("client with a delivered message not archivable")
+	}
+	var archived []handler.Message
+	if err := s.store.Tx(ctx, func(tx *handler.MessageTx) error {
+		if archived, err = tx.Archivable(client, cutoff, 10); err != nil {
+			return err
+		}
+		return tx.Delete(ids(archived))
+	}); err != nil {
+		return err
+	}
+	if fmt.Sprint(ids(archived)) != fmt.Sprint(ids(msgs[:1])) {
+		return fmt.Errorf("archived %v, want %v", ids(archived), ids(msgs[:1]))
+	}
+	if _, err := s.store.Get(ctx, client, id(msgs[0])); !errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("get after delete: %v, want not found", err)
+	}
+	var restored int
+	if err := s.store.Tx(ctx, func(tx *handler.MessageTx) error {
+		restored, err = tx.Restore(append(archived, msgs[1]))
+		return err
+	}); err != nil {
+		return err
+	}
+	if restored != 1 {
+		return fmt.Errorf("restored %d messages, want 1: the other one exists", restored)
+	}
+	back, err := s.store.Get(ctx, client, id(msgs[0]))
+	if err != nil {
+		return err
+	}
+	if back.Status != "DELIVERED" || back.Body != msgs[0].Body {
+		return fmt.Errorf("restored %s %q, archived %s %q", back.Status, back.Body, "DELIVERED", msgs[0].Body)
+	}
+	return nil
+}
+
+// checkRekey seals a plaintext row and rewraps its key. The rows it
+// writes cannot be read back through the hooks without the key, so it
+// looks at them raw.
+func checkRekey(ctx context.Context, s *suite) error {
+	m, err := s.create(ctx, s.client(), "NORMAL", time.Now())
+	if err != nil {
+		return err
+	}
+	pending, err := s.store.NotUnderKey(ctx, "storetest-k1", 1<<20)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, p := range pending {
+		found = found || p.ID == m.ID
+	}
+	if !found {
+		return errors.New("plaintext message not listed as off the key")
+	}
+	raw := func() (handler.Message, error) {
+		var got handler.Message
+		err := s.db.Session(&gorm.Session{SkipHooks: true}).First(&got, "id = ?", m.ID).Error
+		return got, err
+	}
+	for _, body := range []string{"sealed", "sealed again"} {
+		if err := s.store.Seal(ctx, &handler.Message{ID: m.ID, Body: body, To: "sealed-to", ToHash: "h", KeyID: "storetest-k0", WrappedKey: "w0"}); err != nil {
+			return err
+		}
+	}
+	got, err := raw()
+	if err != nil {
+		return err
+	}
+	if got.Body != "sealed" || got.KeyID != "storetest-k0" || got.WrappedKey != "w0" || got.ToHash != "h" {
+		return fmt.Errorf("after sealing twice: body %q key %q/%q hash %q, want the first seal", got.Body, got.KeyID, got.WrappedKey, got.ToHash)
+	}
+	for _, to := range []string{"storetest-k1", "storetest-k2"} {
+		if err := s.store.Rewrap(ctx, m.ID, "storetest-k0", to, "w-"+to); err != nil {
+			return err
+		}
+	}
+	if got, err = raw(); err != nil {
+		return err
+	}
+	if got.KeyID != "storetest-k1" || got.WrappedKey != "w-storetest-k1" || got.Body != "sealed" {
+		return fmt.Errorf("after rewrapping twice: key %q/%q body %q, want the first rewrap", got.KeyID, got.WrappedKey, got.Body)
+	}
+	return nil
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"math/rand"
 	"os"
 	"os/signal"
@@ -11,23 +12,30 @@ import (
 
 	"masanger-worker/handler"
 	initx "masanger-worker/init"
+	"masanger-worker/logging"
 )
 
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	if err := initx.LoadConfigFromJSON("config/config.json"); err != nil {
-		log.Fatal("load config:", err)
+		fatal("load config", err)
+	}
+	logging.Setup("messenger-worker")
+
+	flushTraces, err := initx.InitTracing(context.Background(), "messenger-worker")
+	if err != nil {
+		fatal("tracing", err)
 	}
 
 	brokers := initx.BrokersFromEnv()
 	topic := os.Getenv("WORKER_TOPIC")
 	group := os.Getenv("WORKER_GROUP")
 	if topic == "" {
-		log.Fatal("WORKER_TOPIC is empty")
+		fatal("config", errors.New("WORKER_TOPIC is empty"))
 	}
 	if group == "" {
-		log.Fatal("WORKER_GROUP is empty")
+		fatal("config", errors.New("WORKER_GROUP is empty"))
 	}
 
 	r := initx.NewReader(brokers, group, topic)
@@ -43,6 +51,7 @@ func main() {
 	fail := handler.AtoiEnv("FAIL_RATIO_PCT", 10)
 
 	w := handler.NewWorker(r, ws, operator, worker, acc, min, max, fail)
+	w.Seen = handler.NewRecentIDs(handler.AtoiEnv("DEDUPE_WINDOW", 100000))
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -50,12 +59,17 @@ func main() {
 		w.Run(ctx)
 	}()
 
-	log.Printf("massger-worker started; topic=%s group=%s operator=%s worker=%s\n", topic, group, operator, worker)
+	slog.Info("massger-worker started", "topic", topic, "group", group, "operator", operator, "worker", worker)
 
 	// 5) graceful shutdown
 	waitForSignal()
 	cancel()
 	time.Sleep(300 * time.Millisecond)
+	fctx, fcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer fcancel()
+	if err := flushTraces(fctx); err != nil {
+		slog.Warn("flush traces", "err", err)
+	}
 }
 
 func envOr(k, def string) string {
@@ -65,6 +79,11 @@ func envOr(k, def string) string {
 	}
 	return v
 }
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
 func waitForSignal() {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
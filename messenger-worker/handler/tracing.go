@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("messenger-worker")
+
+// kafkaHeaders carries trace context in Kafka record headers.
+type kafkaHeaders struct{ h *[]kafka.Header }
+
+func (c kafkaHeaders) Get(key string) string {
+	for _, h := range *c.h {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c kafkaHeaders) Set(key, value string) {
+	for i, h := range *c.h {
+		if h.Key == key {
+			(*c.h)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.h = append(*c.h, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c kafkaHeaders) Keys() []string {
+	keys := make([]string, 0, len(*c.h))
+	for _, h := range *c.h {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
@@ -3,19 +3,26 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"masanger-worker/logging"
+
 	"github.com/google/uuid"
 	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 type InMsg struct {
 	MessageID string `json:"message_id"`
 	ClientID  string `json:"client_id"`
+	From      string `json:"from"` // approved sender ID, empty = operator default
 	To        string `json:"to"`
 	Body      string `json:"body"`
 	Type      string `json:"type"`
@@ -44,6 +51,46 @@ type Worker struct {
 	DeliverMin    time.Duration
 	DeliverMax    time.Duration
 	FailRatio     int
+
+	// Seen drops records for message IDs handled recently: message-manager
+	// may publish a message again when it cannot tell the first write
+	// went through, and the user must not get the SMS twice.
+	Seen *RecentIDs
+}
+
+// RecentIDs remembers the last n message IDs it was given.
+type RecentIDs struct {
+	mu   sync.Mutex
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func NewRecentIDs(n int) *RecentIDs {
+	if n <= 0 {
+		n = 1
+	}
+	return &RecentIDs{ids: make(map[string]struct{}, n), ring: make([]string, n)}
+}
+
+// Add records id and reports whether it was new. A nil *RecentIDs
+// remembers nothing.
+func (r *RecentIDs) Add(id string) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.ids[id]; ok {
+		return false
+	}
+	if old := r.ring[r.next]; old != "" {
+		delete(r.ids, old)
+	}
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.ids[id] = struct{}{}
+	return true
 }
 
 func NewWorker(r *kafka.Reader, ws *kafka.Writer,
@@ -67,7 +114,7 @@ func (w *Worker) Run(ctx context.Context) {
 
 func (w *Worker) loop(ctx context.Context, r *kafka.Reader) {
 	defer r.Close()
-	log.Printf("[worker] consuming topic=%s group=%s\n", r.Config().Topic, r.Config().GroupID)
+	slog.Info("consuming", "topic", r.Config().Topic, "group", r.Config().GroupID)
 
 	for {
 		msg, err := r.ReadMessage(ctx)
@@ -75,56 +122,82 @@ func (w *Worker) loop(ctx context.Context, r *kafka.Reader) {
 			if ctx.Err() != nil {
 				return
 			}
-			log.Printf("[worker] read err: %v\n", err)
+			slog.Error("read failed", "err", err)
 			continue
 		}
 		var in InMsg
 		if err := json.Unmarshal(msg.Value, &in); err != nil {
-			log.Printf("[worker] bad json: %v\n", err)
+			slog.ErrorContext(recordContext(ctx, msg), "bad json", "partition", msg.Partition, "offset", msg.Offset, "err", err)
 			continue
 		}
-		trace := uuid.NewString()
-
-		// Accept fast
-		time.Sleep(w.AcceptLatency)
-		_ = w.publish(ctx, StatusEvt{
-			MessageID: in.MessageID,
-			Status:    "ACCEPTED",
-			Operator:  w.Operator,
-			At:        time.Now().UTC().Format(time.RFC3339Nano),
-			TraceID:   trace,
-			Worker:    w.Worker,
-		})
-
-		// Final status
-		delay := w.randomDelay()
-		timer := time.NewTimer(delay)
-		select {
-		case <-ctx.Done():
-			return
-		case <-timer.C:
+		if !w.Seen.Add(in.MessageID) {
+			slog.WarnContext(recordContext(ctx, msg), "duplicate message; skipped", "partition", msg.Partition, "offset", msg.Offset)
+			continue
 		}
-		status := "DELIVERED"
-		if w.shouldFail() {
-			status = "FAILED"
+		if !w.handle(ctx, msg, in) {
+			return
 		}
+	}
+}
 
-		if err := w.publish(ctx, StatusEvt{
-			MessageID: in.MessageID,
-			Status:    status,
-			Operator:  w.Operator,
-			At:        time.Now().UTC().Format(time.RFC3339Nano),
-			TraceID:   trace,
-			Worker:    w.Worker,
-		}); err != nil {
-			log.Printf("[worker] publish err: %v\n", err)
-		}
+// handle submits one message and reports its statuses inside a span that
+// continues the trace message-manager put in the record headers. It
+// returns false when ctx is canceled.
+func (w *Worker) handle(ctx context.Context, msg kafka.Message, in InMsg) bool {
+	ctx, span := tracer.Start(otel.GetTextMapPropagator().Extract(recordContext(ctx, msg), kafkaHeaders{&msg.Headers}), "deliver "+msg.Topic,
+		oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+		oteltrace.WithAttributes(attribute.String("message.id", in.MessageID), attribute.String("operator", w.Operator)))
+	defer span.End()
+
+	trace := uuid.NewString()
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		trace = sc.TraceID().String()
+	}
+
+	// Hand over to the operator (mocked) and accept fast
+	slog.InfoContext(ctx, "submit", "from", in.From, "operator", w.Operator)
+	time.Sleep(w.AcceptLatency)
+	if err := w.publish(ctx, StatusEvt{
+		MessageID: in.MessageID,
+		Status:    "ACCEPTED",
+		Operator:  w.Operator,
+		At:        time.Now().UTC().Format(time.RFC3339Nano),
+		TraceID:   trace,
+		Worker:    w.Worker,
+	}); err != nil {
+		slog.ErrorContext(ctx, "publish failed", "status", "ACCEPTED", "err", err)
+	}
+
+	// Final status
+	delay := w.randomDelay()
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
 	}
+	status := "DELIVERED"
+	if w.shouldFail() {
+		status = "FAILED"
+	}
+	span.SetAttributes(attribute.String("status", status))
+
+	if err := w.publish(ctx, StatusEvt{
+		MessageID: in.MessageID,
+		Status:    status,
+		Operator:  w.Operator,
+		At:        time.Now().UTC().Format(time.RFC3339Nano),
+		TraceID:   trace,
+		Worker:    w.Worker,
+	}); err != nil {
+		slog.ErrorContext(ctx, "publish failed", "status", status, "err", err)
+	}
+	return true
 }
 
 func (w *Worker) publish(ctx context.Context, evt StatusEvt) error {
 	b, _ := json.Marshal(evt)
-	return w.WStatus.WriteMessages(ctx, kafka.Message{
+	m := kafka.Message{
 		Key:   []byte(evt.MessageID),
 		Value: b,
 		Headers: []kafka.Header{
@@ -134,7 +207,25 @@ func (w *Worker) publish(ctx context.Context, evt StatusEvt) error {
 			{Key: "x-trace-id", Value: []byte(evt.TraceID)},
 			{Key: "x-worker", Value: []byte(evt.Worker)},
 		},
-	})
+	}
+	// carry the correlation IDs back to message-manager
+	if cid := logging.Field(ctx, logging.ClientID); cid != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: "x-client-id", Value: []byte(cid)})
+	}
+	if rid := logging.Field(ctx, logging.RequestID); rid != "" {
+		m.Headers = append(m.Headers, kafka.Header{Key: "x-request-id", Value: []byte(rid)})
+	}
+	otel.GetTextMapPropagator().Inject(ctx, kafkaHeaders{&m.Headers})
+	return w.WStatus.WriteMessages(ctx, m)
+}
+
+// recordContext tags ctx with the IDs message-manager put in a record's
+// headers.
+func recordContext(ctx context.Context, m kafka.Message) context.Context {
+	h := kafkaHeaders{&m.Headers}
+	ctx = logging.With(ctx, logging.MessageID, h.Get("x-msg-id"))
+	ctx = logging.With(ctx, logging.ClientID, h.Get("x-client-id"))
+	return logging.With(ctx, logging.RequestID, h.Get("x-request-id"))
 }
 
 func (w *Worker) randomDelay() time.Duration {